@@ -0,0 +1,252 @@
+package cloudsql
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// MaxAclRetries is the max number of retries of modifying authorized networks on conflicts
+	MaxAclRetries = 5
+	// aclRetryInterval is the base interval between retries, which grows linearly
+	aclRetryInterval = 2 * time.Second
+)
+
+// ErrAclConflict is returned when the authorized networks keep being modified concurrently
+var ErrAclConflict = errors.New("authorized networks are modified concurrently")
+
+// NewAclEntry builds the authorized network of the IP or CIDR, which expires after ttl
+// if ttl is positive. The value is normalized, e.g. `10.0.0.5/24` to `10.0.0.0/24` and `10.0.0.5` to `10.0.0.5/32`.
+func NewAclEntry(name, value string, ttl time.Duration) (*sql.AclEntry, error) {
+	normalized, err := normalizeNetwork(value)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &sql.AclEntry{
+		Kind:  "sql#aclEntry",
+		Name:  name,
+		Value: normalized,
+	}
+	if ttl > 0 {
+		entry.ExpirationTime = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	return entry, nil
+}
+
+// ListAuthorizedNetworks lists the unexpired authorized networks of the database instance
+func (m *Manager) ListAuthorizedNetworks(projectID, dbName string) ([]*sql.AclEntry, error) {
+	log.Tracef("ListAuthorizedNetworks: projectID[%s], db[%s]", projectID, dbName)
+
+	dbInstance, err := m.GetDatabase(projectID, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _ := pruneExpiredAclEntries(authorizedNetworks(dbInstance), time.Now())
+	return entries, nil
+}
+
+// AddAuthorizedNetworks adds the authorized networks to the database instance.
+// The entry of the same network is replaced, and the values are validated and normalized.
+// It's safe to be called concurrently, see modifyAuthorizedNetworks.
+func (m *Manager) AddAuthorizedNetworks(projectID, dbName string, entries []*sql.AclEntry) error {
+	log.Debugf("AddAuthorizedNetworks: projectID[%s], db[%s], count[%d]", projectID, dbName, len(entries))
+
+	added := make([]*sql.AclEntry, 0, len(entries))
+	for _, entry := range entries {
+		normalized, err := normalizeNetwork(entry.Value)
+		if err != nil {
+			return errors.Wrapf(err, "name[%s]", entry.Name)
+		}
+		e := *entry
+		e.Value = normalized
+		added = append(added, &e)
+	}
+
+	return m.modifyAuthorizedNetworks(projectID, dbName, func(current []*sql.AclEntry) ([]*sql.AclEntry, bool) {
+		return mergeAclEntries(current, added)
+	})
+}
+
+// RemoveAuthorizedNetworks removes the authorized networks matching any of names or networks (IP or CIDR)
+// from the database instance. It's safe to be called concurrently, see modifyAuthorizedNetworks.
+func (m *Manager) RemoveAuthorizedNetworks(projectID, dbName string, namesOrNetworks []string) error {
+	log.Debugf("RemoveAuthorizedNetworks: projectID[%s], db[%s], removed%v", projectID, dbName, namesOrNetworks)
+
+	return m.modifyAuthorizedNetworks(projectID, dbName, func(current []*sql.AclEntry) ([]*sql.AclEntry, bool) {
+		return removeAclEntries(current, namesOrNetworks)
+	})
+}
+
+// PruneExpiredAuthorizedNetworks removes the authorized networks passing their expiration time
+func (m *Manager) PruneExpiredAuthorizedNetworks(projectID, dbName string) error {
+	log.Debugf("PruneExpiredAuthorizedNetworks: projectID[%s], db[%s]", projectID, dbName)
+
+	return m.modifyAuthorizedNetworks(projectID, dbName, func(current []*sql.AclEntry) ([]*sql.AclEntry, bool) {
+		return current, false
+	})
+}
+
+// modifyAuthorizedNetworks reads the authorized networks, prunes the expired ones and applies modify.
+// The patch is guarded by the etag and the settings version of the read, and retried from the read
+// on conflicts, so that concurrent modifications are not lost. It blocks till the patch is done.
+func (m *Manager) modifyAuthorizedNetworks(
+	projectID, dbName string, modify func([]*sql.AclEntry) ([]*sql.AclEntry, bool)) error {
+
+	for retry := 0; retry <= MaxAclRetries; retry++ {
+		if retry > 0 {
+			time.Sleep(time.Duration(retry) * aclRetryInterval)
+		}
+
+		dbInstance, err := m.GetDatabase(projectID, dbName)
+		if err != nil {
+			return err
+		}
+
+		entries, pruned := pruneExpiredAclEntries(authorizedNetworks(dbInstance), time.Now())
+		entries, changed := modify(entries)
+		if !pruned && !changed {
+			return nil
+		}
+
+		patch := &sql.DatabaseInstance{
+			Settings: &sql.Settings{
+				SettingsVersion: dbInstance.Settings.SettingsVersion,
+				IpConfiguration: &sql.IpConfiguration{
+					AuthorizedNetworks: entries,
+					// send the empty list to remove all entries
+					ForceSendFields: []string{"AuthorizedNetworks"},
+				},
+			},
+		}
+		call := m.Service.Instances.Patch(projectID, dbName, patch)
+		if dbInstance.Etag != "" {
+			call.Header().Set("If-Match", dbInstance.Etag)
+		}
+
+		op, err := call.Do()
+		if isConflict(err) {
+			log.Debugf("Authorized networks conflict: db[%s], retry[%d]", dbName, retry)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return m.WaitOperation(projectID, op)
+	}
+
+	return ErrAclConflict
+}
+
+func authorizedNetworks(dbInstance *sql.DatabaseInstance) []*sql.AclEntry {
+	if dbInstance.Settings == nil || dbInstance.Settings.IpConfiguration == nil {
+		return []*sql.AclEntry{}
+	}
+
+	return dbInstance.Settings.IpConfiguration.AuthorizedNetworks
+}
+
+func isConflict(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && (apiErr.Code == http.StatusConflict || apiErr.Code == http.StatusPreconditionFailed)
+}
+
+// normalizeNetwork validates the IP or CIDR and returns its canonical CIDR form,
+// a bare IPv4 is the /32 network and a bare IPv6 is the /128 network
+func normalizeNetwork(value string) (string, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", errors.Errorf("invalid IP or CIDR: value[%s]", value)
+	}
+
+	return ipNet.String(), nil
+}
+
+// pruneExpiredAclEntries removes the entries expired at now, and reports whether any is removed
+func pruneExpiredAclEntries(entries []*sql.AclEntry, now time.Time) ([]*sql.AclEntry, bool) {
+	result := make([]*sql.AclEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ExpirationTime != "" {
+			expiration, err := time.Parse(time.RFC3339, entry.ExpirationTime)
+			if err == nil && !now.Before(expiration) {
+				continue
+			}
+		}
+		result = append(result, entry)
+	}
+
+	return result, len(result) != len(entries)
+}
+
+// mergeAclEntries adds the entries, the current entry of the same network is replaced
+func mergeAclEntries(current, added []*sql.AclEntry) ([]*sql.AclEntry, bool) {
+	result := append([]*sql.AclEntry{}, current...)
+	changed := false
+	for _, entry := range added {
+		replaced := false
+		for i, c := range result {
+			if sameNetwork(c.Value, entry.Value) {
+				if c.Name != entry.Name || c.ExpirationTime != entry.ExpirationTime {
+					result[i] = entry
+					changed = true
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			result = append(result, entry)
+			changed = true
+		}
+	}
+
+	return result, changed
+}
+
+// removeAclEntries removes the entries matching any of names or networks
+func removeAclEntries(current []*sql.AclEntry, namesOrNetworks []string) ([]*sql.AclEntry, bool) {
+	result := make([]*sql.AclEntry, 0, len(current))
+	for _, entry := range current {
+		removed := false
+		for _, v := range namesOrNetworks {
+			if entry.Name == v || sameNetwork(entry.Value, v) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			result = append(result, entry)
+		}
+	}
+
+	return result, len(result) != len(current)
+}
+
+func sameNetwork(a, b string) bool {
+	na, err := normalizeNetwork(a)
+	if err != nil {
+		return a == b
+	}
+	nb, err := normalizeNetwork(b)
+	if err != nil {
+		return false
+	}
+
+	return na == nb
+}
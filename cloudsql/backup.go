@@ -0,0 +1,208 @@
+package cloudsql
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// FileTypeSQL is the file type of mysqldump
+	FileTypeSQL = "SQL"
+	// FileTypeCSV is the file type of CSV
+	FileTypeCSV = "CSV"
+
+	// BackupRunTypeOnDemand is the type of backup runs created by CreateBackup
+	BackupRunTypeOnDemand = "ON_DEMAND"
+)
+
+// CreateBackup creates an on-demand backup of the database instance and blocks till it's done.
+// The created backup run is returned. A random tag is appended to the description,
+// e.g. `nightly [5f1c9a0e2b7d4c33]`, to tell the created run from older ones.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#BackupRunsService.Insert
+func (m *Manager) CreateBackup(projectID, dbName, description string) (*sql.BackupRun, error) {
+	log.Debugf("CreateBackup: projectID[%s], db[%s], description[%s]", projectID, dbName, description)
+
+	description, err := taggedDescription(description)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := m.Service.BackupRuns.Insert(projectID, dbName, &sql.BackupRun{Description: description}).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WaitOperation(projectID, op); err != nil {
+		return nil, err
+	}
+
+	// backup runs are listed in reverse chronological order
+	backupRuns, err := m.ListBackupRuns(projectID, dbName)
+	if err != nil {
+		return nil, err
+	}
+	for _, backupRun := range backupRuns {
+		if backupRun.Type == BackupRunTypeOnDemand && backupRun.Description == description {
+			return backupRun, nil
+		}
+	}
+
+	return nil, errors.Errorf("created backup run not found: db[%s], description[%s]", dbName, description)
+}
+
+// taggedDescription appends the random tag to the description
+func taggedDescription(description string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate tag fails")
+	}
+
+	tag := "[" + hex.EncodeToString(b) + "]"
+	if description == "" {
+		return tag, nil
+	}
+
+	return description + " " + tag, nil
+}
+
+// ListBackupRuns lists all backup runs of the database instance, the newest first.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#BackupRunsService.List
+func (m *Manager) ListBackupRuns(projectID, dbName string) ([]*sql.BackupRun, error) {
+	log.Tracef("ListBackupRuns: projectID[%s], db[%s]", projectID, dbName)
+
+	backupRuns := []*sql.BackupRun{}
+	pageToken := ""
+	for {
+		call := m.Service.BackupRuns.List(projectID, dbName)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+
+		backupRuns = append(backupRuns, res.Items...)
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	return backupRuns, nil
+}
+
+// DeleteBackupRun deletes the backup run and blocks till it's deleted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#BackupRunsService.Delete
+func (m *Manager) DeleteBackupRun(projectID, dbName string, backupRunID int64) error {
+	log.Debugf("DeleteBackupRun: projectID[%s], db[%s], backupRun[%d]", projectID, dbName, backupRunID)
+
+	op, err := m.Service.BackupRuns.Delete(projectID, dbName, backupRunID).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// RestoreBackup restores the backup run of the source instance into the target instance,
+// which could be the source instance itself. All data of the target instance is overwritten.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.RestoreBackup
+func (m *Manager) RestoreBackup(projectID, targetName, sourceName string, backupRunID int64) error {
+	log.Debugf("RestoreBackup: projectID[%s], target[%s], source[%s], backupRun[%d]",
+		projectID, targetName, sourceName, backupRunID)
+
+	request := &sql.InstancesRestoreBackupRequest{
+		RestoreBackupContext: &sql.RestoreBackupContext{
+			BackupRunId: backupRunID,
+			InstanceId:  sourceName,
+		},
+	}
+	op, err := m.Service.Instances.RestoreBackup(projectID, targetName, request).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// ExportSQL exports the databases (all databases if empty) as mysqldump to the GCS uri,
+// e.g. `gs://bucket/path/dump.sql.gz`, and blocks till it's done.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Export
+func (m *Manager) ExportSQL(projectID, dbName, uri string, databases []string) error {
+	log.Debugf("ExportSQL: projectID[%s], db[%s], uri[%s], databases%v", projectID, dbName, uri, databases)
+
+	return m.export(projectID, dbName, &sql.ExportContext{
+		FileType:  FileTypeSQL,
+		Uri:       uri,
+		Databases: databases,
+	})
+}
+
+// ExportCSV exports the result of the select query on the database as CSV to the GCS uri,
+// and blocks till it's done.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Export
+func (m *Manager) ExportCSV(projectID, dbName, uri, database, selectQuery string) error {
+	log.Debugf("ExportCSV: projectID[%s], db[%s], uri[%s], database[%s]", projectID, dbName, uri, database)
+
+	return m.export(projectID, dbName, &sql.ExportContext{
+		FileType:         FileTypeCSV,
+		Uri:              uri,
+		Databases:        []string{database},
+		CsvExportOptions: &sql.ExportContextCsvExportOptions{SelectQuery: selectQuery},
+	})
+}
+
+// ImportSQL imports the mysqldump from the GCS uri into the database (could be empty if
+// the dump specifies it), and blocks till it's done.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Import
+func (m *Manager) ImportSQL(projectID, dbName, uri, database string) error {
+	log.Debugf("ImportSQL: projectID[%s], db[%s], uri[%s], database[%s]", projectID, dbName, uri, database)
+
+	return m.importFrom(projectID, dbName, &sql.ImportContext{
+		FileType: FileTypeSQL,
+		Uri:      uri,
+		Database: database,
+	})
+}
+
+// ImportCSV imports the CSV from the GCS uri into the table of the database, and blocks till it's done.
+// Empty columns means the CSV has all columns of the table in order.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Import
+func (m *Manager) ImportCSV(projectID, dbName, uri, database, table string, columns []string) error {
+	log.Debugf("ImportCSV: projectID[%s], db[%s], uri[%s], database[%s], table[%s]",
+		projectID, dbName, uri, database, table)
+
+	return m.importFrom(projectID, dbName, &sql.ImportContext{
+		FileType: FileTypeCSV,
+		Uri:      uri,
+		Database: database,
+		CsvImportOptions: &sql.ImportContextCsvImportOptions{
+			Table:   table,
+			Columns: columns,
+		},
+	})
+}
+
+func (m *Manager) export(projectID, dbName string, exportContext *sql.ExportContext) error {
+	request := &sql.InstancesExportRequest{ExportContext: exportContext}
+	op, err := m.Service.Instances.Export(projectID, dbName, request).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+func (m *Manager) importFrom(projectID, dbName string, importContext *sql.ImportContext) error {
+	request := &sql.InstancesImportRequest{ImportContext: importContext}
+	op, err := m.Service.Instances.Import(projectID, dbName, request).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
@@ -54,7 +54,8 @@ func (m *Manager) GetDatabase(projectID, dbName string) (*sql.DatabaseInstance,
 	return dbInstance, nil
 }
 
-// PatchAclEntriesOfDatabase updates the aclEntries settings of the database instance
+// PatchAclEntriesOfDatabase updates the aclEntries settings of the database instance.
+// It replaces the whole list, use AddAuthorizedNetworks/RemoveAuthorizedNetworks for concurrent editing.
 func (m *Manager) PatchAclEntriesOfDatabase(projectID, dbName string, entries []*sql.AclEntry) (*sql.Operation, error) {
 	log.Debugf("PatchAclEntriesOfDatabase: projectID[%s], db[%s]", projectID, dbName)
 
@@ -73,7 +74,8 @@ func (m *Manager) PatchAclEntriesOfDatabase(projectID, dbName string, entries []
 	return dbInstanceService.Patch(projectID, dbName, dbInstance).Do()
 }
 
-// GetFilteredAclEntriesOfDatabase gets aclEntries which satisfies entry name filter
+// GetFilteredAclEntriesOfDatabase gets aclEntries which satisfies entry name filter.
+// See also ListAuthorizedNetworks.
 func (m *Manager) GetFilteredAclEntriesOfDatabase(
 	projectID, dbName string, notContain func(string) bool) ([]*sql.AclEntry, error) {
 
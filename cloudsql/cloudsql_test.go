@@ -1,11 +1,13 @@
 package cloudsql
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/facebookgo/inject"
 	"github.com/iKala/gogoo/config"
@@ -81,3 +83,212 @@ func (suite *CloudSQLManagerTestSuite) Test03_GetFilteredAclEntriesOfDatabase()
 		log.Printf("entry: name[%s]", entry.Name)
 	}
 }
+
+func (suite *CloudSQLManagerTestSuite) Test04_InstanceLifecycle() {
+	if testing.Short() {
+		suite.T().Skip("creating instance takes minutes")
+	}
+
+	dbName := fmt.Sprintf("gogoo-test-%d", time.Now().Unix())
+	dbInstance, err := testedCloudSQLManager.CreateInstance(testedProjectID, &sqladmin.DatabaseInstance{
+		Name:            dbName,
+		Region:          "asia-east1",
+		DatabaseVersion: "MYSQL_5_6",
+		Settings:        &sqladmin.Settings{Tier: "db-f1-micro"},
+	})
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	assert.Equal(suite.T(), dbName, dbInstance.Name)
+	defer func() {
+		assert.Nil(suite.T(), testedCloudSQLManager.DeleteInstance(testedProjectID, dbName))
+	}()
+
+	assert.Nil(suite.T(), testedCloudSQLManager.RestartInstance(testedProjectID, dbName))
+
+	assert.Nil(suite.T(), testedCloudSQLManager.StopInstance(testedProjectID, dbName))
+	dbInstance, _ = testedCloudSQLManager.GetDatabase(testedProjectID, dbName)
+	assert.Equal(suite.T(), ActivationPolicyNever, dbInstance.Settings.ActivationPolicy)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.StartInstance(testedProjectID, dbName))
+	dbInstance, _ = testedCloudSQLManager.GetDatabase(testedProjectID, dbName)
+	assert.Equal(suite.T(), ActivationPolicyAlways, dbInstance.Settings.ActivationPolicy)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.ResizeInstance(testedProjectID, dbName, "db-g1-small", 20))
+	dbInstance, _ = testedCloudSQLManager.GetDatabase(testedProjectID, dbName)
+	assert.Equal(suite.T(), "db-g1-small", dbInstance.Settings.Tier)
+	assert.Equal(suite.T(), int64(20), dbInstance.Settings.DataDiskSizeGb)
+}
+
+func (suite *CloudSQLManagerTestSuite) Test05_OperationError() {
+	err := &OperationError{
+		Operation: &sqladmin.Operation{Name: "op", OperationType: "RESTART", TargetId: "db"},
+		Errors:    []*sqladmin.OperationError{{Code: "INTERNAL_ERROR", Message: "boom"}},
+	}
+	assert.Equal(suite.T(),
+		"operation fails: name[op], type[RESTART], target[db], errors[INTERNAL_ERROR: boom]", err.Error())
+}
+
+func (suite *CloudSQLManagerTestSuite) Test06_BackupRuns() {
+	if testing.Short() {
+		suite.T().Skip("backup takes minutes")
+	}
+
+	description := fmt.Sprintf("gogoo-test-%d", time.Now().Unix())
+	backupRun, err := testedCloudSQLManager.CreateBackup(testedProjectID, "test-database", description)
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	assert.Equal(suite.T(), BackupRunTypeOnDemand, backupRun.Type)
+	assert.True(suite.T(), strings.HasPrefix(backupRun.Description, description+" ["))
+
+	backupRuns, err := testedCloudSQLManager.ListBackupRuns(testedProjectID, "test-database")
+	assert.Nil(suite.T(), err)
+	found := false
+	for _, run := range backupRuns {
+		found = found || run.Id == backupRun.Id
+	}
+	assert.True(suite.T(), found)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.RestoreBackup(testedProjectID, "test-database", "test-database", backupRun.Id))
+	assert.Nil(suite.T(), testedCloudSQLManager.DeleteBackupRun(testedProjectID, "test-database", backupRun.Id))
+}
+
+func (suite *CloudSQLManagerTestSuite) Test07_ExportThenImportSQL() {
+	if testing.Short() {
+		suite.T().Skip("export takes minutes")
+	}
+
+	uri := fmt.Sprintf("gs://livehouse-test/gogoo/cloudsql-dump-%d.sql.gz", time.Now().Unix())
+	assert.Nil(suite.T(), testedCloudSQLManager.ExportSQL(testedProjectID, "test-database", uri, nil))
+	assert.Nil(suite.T(), testedCloudSQLManager.ImportSQL(testedProjectID, "test-database", uri, ""))
+}
+
+func (suite *CloudSQLManagerTestSuite) Test08_ProvisionTenant() {
+	tenant := fmt.Sprintf("tenant%d", time.Now().Unix()%100000)
+	credentials, err := testedCloudSQLManager.ProvisionTenant(
+		testedProjectID, "test-database", tenant, AnyHost, "utf8mb4", "utf8mb4_unicode_ci")
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	assert.Equal(suite.T(), tenant, credentials.Database)
+	assert.NotEmpty(suite.T(), credentials.Password)
+
+	databases, err := testedCloudSQLManager.ListDatabases(testedProjectID, "test-database")
+	assert.Nil(suite.T(), err)
+	found := false
+	for _, database := range databases {
+		found = found || database.Name == tenant
+	}
+	assert.True(suite.T(), found)
+
+	password, err := testedCloudSQLManager.RotateUserPassword(testedProjectID, "test-database", tenant, AnyHost)
+	assert.Nil(suite.T(), err)
+	assert.NotEqual(suite.T(), credentials.Password, password)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.DeleteUser(testedProjectID, "test-database", tenant, AnyHost))
+	assert.Nil(suite.T(), testedCloudSQLManager.DeleteDatabase(testedProjectID, "test-database", tenant))
+}
+
+func (suite *CloudSQLManagerTestSuite) Test09_AclEntries() {
+	_, err := NewAclEntry("bad", "1.1.1.300", 0)
+	assert.NotNil(suite.T(), err)
+
+	entry, err := NewAclEntry("office", "10.0.0.5/24", time.Hour)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "10.0.0.0/24", entry.Value)
+	assert.NotEmpty(suite.T(), entry.ExpirationTime)
+
+	// bare IPs are single address networks
+	single, _ := NewAclEntry("vm", "1.1.1.1", 0)
+	assert.Equal(suite.T(), "1.1.1.1/32", single.Value)
+	single, _ = NewAclEntry("vm", "2001:db8::1", 0)
+	assert.Equal(suite.T(), "2001:db8::1/128", single.Value)
+	assert.True(suite.T(), sameNetwork("1.1.1.1", "1.1.1.1/32"))
+	assert.True(suite.T(), sameNetwork("2001:db8::1/128", "2001:db8::1"))
+	assert.False(suite.T(), sameNetwork("1.1.1.1", "1.1.1.0/24"))
+
+	current := []*sqladmin.AclEntry{
+		{Name: "a", Value: "1.1.1.1"},
+		{Name: "b", Value: "2.2.2.0/24"},
+		{Name: "expired", Value: "3.3.3.3", ExpirationTime: "2000-01-01T00:00:00Z"},
+	}
+	current, pruned := pruneExpiredAclEntries(current, time.Now())
+	assert.True(suite.T(), pruned)
+	assert.Equal(suite.T(), 2, len(current))
+
+	merged, changed := mergeAclEntries(current, []*sqladmin.AclEntry{{Name: "a", Value: "1.1.1.1"}, entry})
+	assert.True(suite.T(), changed)
+	assert.Equal(suite.T(), 3, len(merged))
+	_, changed = mergeAclEntries(merged, []*sqladmin.AclEntry{{Name: "a", Value: "1.1.1.1"}})
+	assert.False(suite.T(), changed)
+	_, changed = mergeAclEntries(merged, []*sqladmin.AclEntry{{Name: "a", Value: "1.1.1.1/32"}})
+	assert.False(suite.T(), changed)
+
+	removed, changed := removeAclEntries(merged, []string{"a", "2.2.2.9/24"})
+	assert.True(suite.T(), changed)
+	assert.Equal(suite.T(), []*sqladmin.AclEntry{entry}, removed)
+}
+
+func (suite *CloudSQLManagerTestSuite) Test10_AddThenRemoveAuthorizedNetworks() {
+	entry, _ := NewAclEntry("gogoo-test", "1.1.1.3", time.Hour)
+	assert.Nil(suite.T(), testedCloudSQLManager.AddAuthorizedNetworks(
+		testedProjectID, "test-database", []*sqladmin.AclEntry{entry}))
+
+	entries, err := testedCloudSQLManager.ListAuthorizedNetworks(testedProjectID, "test-database")
+	assert.Nil(suite.T(), err)
+	found := false
+	for _, e := range entries {
+		found = found || e.Name == "gogoo-test"
+	}
+	assert.True(suite.T(), found)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.RemoveAuthorizedNetworks(
+		testedProjectID, "test-database", []string{"gogoo-test"}))
+}
+
+func (suite *CloudSQLManagerTestSuite) Test11_DiffAclEntries() {
+	current := []*sqladmin.AclEntry{
+		{Name: "office", Value: "1.1.1.1"},
+		{Name: "gogoo-vm-a", Value: "2.2.2.2"},
+		{Name: "gogoo-vm-b", Value: "3.3.3.3"},
+		{Name: "gogoo-vm-deleted", Value: "4.4.4.4"},
+	}
+	desired := []*sqladmin.AclEntry{
+		{Name: "gogoo-vm-a", Value: "2.2.2.2"},
+		{Name: "gogoo-vm-b", Value: "5.5.5.5"},
+		{Name: "gogoo-vm-c", Value: "6.6.6.6"},
+	}
+
+	next, diff := diffAclEntries(current, desired, DefaultManagedAclPrefix)
+	assert.Equal(suite.T(), []*sqladmin.AclEntry{current[0], current[1], desired[1], desired[2]}, next)
+	assert.Equal(suite.T(), []*sqladmin.AclEntry{desired[1], desired[2]}, diff.Added)
+	assert.Equal(suite.T(), []*sqladmin.AclEntry{current[2], current[3]}, diff.Removed)
+
+	_, diff = diffAclEntries(next, desired, DefaultManagedAclPrefix)
+	assert.True(suite.T(), diff.Empty())
+}
+
+func (suite *CloudSQLManagerTestSuite) Test12_ReadReplica() {
+	if testing.Short() {
+		suite.T().Skip("creating replica takes minutes")
+	}
+
+	replicaName := fmt.Sprintf("test-database-replica-%d", time.Now().Unix())
+	replica, err := testedCloudSQLManager.CreateReadReplica(testedProjectID, "test-database", replicaName, "")
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	assert.Equal(suite.T(), "test-database", replica.MasterInstanceName)
+
+	replicas, err := testedCloudSQLManager.ListReplicas(testedProjectID, "test-database", nil)
+	assert.Nil(suite.T(), err)
+	found := false
+	for _, r := range replicas {
+		found = found || r.Instance.Name == replicaName
+	}
+	assert.True(suite.T(), found)
+
+	assert.Nil(suite.T(), testedCloudSQLManager.PromoteReplica(testedProjectID, replicaName))
+	assert.Nil(suite.T(), testedCloudSQLManager.DeleteInstance(testedProjectID, replicaName))
+}
@@ -0,0 +1,187 @@
+package cloudsql
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// AnyHost is the host of users which could connect from any host
+	AnyHost = "%"
+	// passwordBytes is the number of random bytes of generated passwords
+	passwordBytes = 24
+)
+
+// TenantCredentials is the database and the credentials created by ProvisionTenant
+type TenantCredentials struct {
+	Database string
+	User     string
+	Host     string
+	Password string
+}
+
+// ListDatabases lists the databases of the database instance.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#DatabasesService.List
+func (m *Manager) ListDatabases(projectID, dbName string) ([]*sql.Database, error) {
+	log.Tracef("ListDatabases: projectID[%s], db[%s]", projectID, dbName)
+
+	res, err := m.Service.Databases.List(projectID, dbName).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Items, nil
+}
+
+// CreateDatabase creates the database on the database instance and blocks till it's created.
+// Empty charset or collation means the default of the instance.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#DatabasesService.Insert
+func (m *Manager) CreateDatabase(projectID, dbName, database, charset, collation string) error {
+	log.Debugf("CreateDatabase: projectID[%s], db[%s], database[%s], charset[%s], collation[%s]",
+		projectID, dbName, database, charset, collation)
+
+	op, err := m.Service.Databases.Insert(projectID, dbName, &sql.Database{
+		Name:      database,
+		Instance:  dbName,
+		Project:   projectID,
+		Charset:   charset,
+		Collation: collation,
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DeleteDatabase deletes the database from the database instance and blocks till it's deleted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#DatabasesService.Delete
+func (m *Manager) DeleteDatabase(projectID, dbName, database string) error {
+	log.Debugf("DeleteDatabase: projectID[%s], db[%s], database[%s]", projectID, dbName, database)
+
+	op, err := m.Service.Databases.Delete(projectID, dbName, database).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// ListUsers lists the users of the database instance.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#UsersService.List
+func (m *Manager) ListUsers(projectID, dbName string) ([]*sql.User, error) {
+	log.Tracef("ListUsers: projectID[%s], db[%s]", projectID, dbName)
+
+	res, err := m.Service.Users.List(projectID, dbName).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Items, nil
+}
+
+// CreateUser creates the user on the database instance and blocks till it's created.
+// Use AnyHost for the user connecting from any host.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#UsersService.Insert
+func (m *Manager) CreateUser(projectID, dbName, name, host, password string) error {
+	log.Debugf("CreateUser: projectID[%s], db[%s], user[%s], host[%s]", projectID, dbName, name, host)
+
+	op, err := m.Service.Users.Insert(projectID, dbName, &sql.User{
+		Name:     name,
+		Host:     host,
+		Password: password,
+		Instance: dbName,
+		Project:  projectID,
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DeleteUser deletes the user from the database instance and blocks till it's deleted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#UsersService.Delete
+func (m *Manager) DeleteUser(projectID, dbName, name, host string) error {
+	log.Debugf("DeleteUser: projectID[%s], db[%s], user[%s], host[%s]", projectID, dbName, name, host)
+
+	op, err := m.Service.Users.Delete(projectID, dbName, host, name).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// SetUserPassword sets the password of the user and blocks till it's updated.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#UsersService.Update
+func (m *Manager) SetUserPassword(projectID, dbName, name, host, password string) error {
+	log.Debugf("SetUserPassword: projectID[%s], db[%s], user[%s], host[%s]", projectID, dbName, name, host)
+
+	op, err := m.Service.Users.Update(projectID, dbName, name, &sql.User{
+		Name:     name,
+		Host:     host,
+		Password: password,
+	}).Host(host).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// RotateUserPassword sets a random password to the user and returns it
+func (m *Manager) RotateUserPassword(projectID, dbName, name, host string) (string, error) {
+	password, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.SetUserPassword(projectID, dbName, name, host, password); err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// ProvisionTenant creates the database and the user of the same name with a random password,
+// which connects from the host. The database is deleted if the user cannot be created.
+func (m *Manager) ProvisionTenant(projectID, dbName, tenant, host, charset, collation string) (*TenantCredentials, error) {
+	log.Debugf("ProvisionTenant: projectID[%s], db[%s], tenant[%s]", projectID, dbName, tenant)
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.CreateDatabase(projectID, dbName, tenant, charset, collation); err != nil {
+		return nil, errors.Wrapf(err, "create database fails: tenant[%s]", tenant)
+	}
+
+	if err := m.CreateUser(projectID, dbName, tenant, host, password); err != nil {
+		if deleteErr := m.DeleteDatabase(projectID, dbName, tenant); deleteErr != nil {
+			log.Warnf("Delete database fails: tenant[%s], err[%s]", tenant, deleteErr)
+		}
+		return nil, errors.Wrapf(err, "create user fails: tenant[%s]", tenant)
+	}
+
+	return &TenantCredentials{
+		Database: tenant,
+		User:     tenant,
+		Host:     host,
+		Password: password,
+	}, nil
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, passwordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate password fails")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
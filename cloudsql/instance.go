@@ -0,0 +1,199 @@
+package cloudsql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// OperationTimeout is timeout of waiting an operation to be done
+	OperationTimeout = 30 * time.Minute
+	// OperationPollingInterval is the interval of polling the status of an operation
+	OperationPollingInterval = 5 * time.Second
+
+	// OperationStatusDone ...
+	OperationStatusDone = "DONE"
+
+	// ActivationPolicyAlways keeps the instance running
+	ActivationPolicyAlways = "ALWAYS"
+	// ActivationPolicyNever keeps the instance stopped
+	ActivationPolicyNever = "NEVER"
+)
+
+// ErrOperationTimeout is returned when the operation isn't done within OperationTimeout
+var ErrOperationTimeout = errors.New("operation timeout")
+
+// OperationError is returned when the operation is done with errors
+type OperationError struct {
+	Operation *sql.Operation
+	Errors    []*sql.OperationError
+}
+
+func (e *OperationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, oe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", oe.Code, oe.Message))
+	}
+
+	return fmt.Sprintf("operation fails: name[%s], type[%s], target[%s], errors[%s]",
+		e.Operation.Name, e.Operation.OperationType, e.Operation.TargetId, strings.Join(msgs, "; "))
+}
+
+// WaitOperation blocks till the operation to be done, or will be timeout if it takes over `OperationTimeout`.
+// *OperationError is returned if the operation is done with errors.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#OperationsService.Get
+func (m *Manager) WaitOperation(projectID string, op *sql.Operation) error {
+	log.Tracef("WaitOperation: projectID[%s], operation[%s], type[%s]", projectID, op.Name, op.OperationType)
+
+	startTime := time.Now()
+	for op.Status != OperationStatusDone {
+		if time.Now().Sub(startTime) > OperationTimeout {
+			log.Warnf("Operation timeout: operation[%s], type[%s]", op.Name, op.OperationType)
+			return ErrOperationTimeout
+		}
+
+		time.Sleep(OperationPollingInterval)
+
+		polled, err := m.Service.Operations.Get(projectID, op.Name).Do()
+		if err != nil {
+			return errors.Wrapf(err, "get operation fails: operation[%s]", op.Name)
+		}
+		op = polled
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &OperationError{Operation: op, Errors: op.Error.Errors}
+	}
+
+	return nil
+}
+
+// CreateInstance creates the database instance and blocks till it's created.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Insert
+func (m *Manager) CreateInstance(projectID string, instance *sql.DatabaseInstance) (*sql.DatabaseInstance, error) {
+	log.Debugf("CreateInstance: projectID[%s], db[%s]", projectID, instance.Name)
+
+	op, err := m.Service.Instances.Insert(projectID, instance).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WaitOperation(projectID, op); err != nil {
+		return nil, err
+	}
+
+	return m.GetDatabase(projectID, instance.Name)
+}
+
+// CloneInstance clones the source instance to the destination instance and blocks till it's cloned.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Clone
+func (m *Manager) CloneInstance(projectID, sourceName, destinationName string) (*sql.DatabaseInstance, error) {
+	log.Debugf("CloneInstance: projectID[%s], source[%s], destination[%s]", projectID, sourceName, destinationName)
+
+	request := &sql.InstancesCloneRequest{
+		CloneContext: &sql.CloneContext{DestinationInstanceName: destinationName},
+	}
+	op, err := m.Service.Instances.Clone(projectID, sourceName, request).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WaitOperation(projectID, op); err != nil {
+		return nil, err
+	}
+
+	return m.GetDatabase(projectID, destinationName)
+}
+
+// RestartInstance restarts the database instance and blocks till it's restarted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Restart
+func (m *Manager) RestartInstance(projectID, dbName string) error {
+	log.Debugf("RestartInstance: projectID[%s], db[%s]", projectID, dbName)
+
+	op, err := m.Service.Instances.Restart(projectID, dbName).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// StopInstance stops the database instance by setting the activation policy to NEVER
+func (m *Manager) StopInstance(projectID, dbName string) error {
+	log.Debugf("StopInstance: projectID[%s], db[%s]", projectID, dbName)
+
+	return m.patchSettings(projectID, dbName, &sql.Settings{ActivationPolicy: ActivationPolicyNever})
+}
+
+// StartInstance starts the database instance by setting the activation policy to ALWAYS
+func (m *Manager) StartInstance(projectID, dbName string) error {
+	log.Debugf("StartInstance: projectID[%s], db[%s]", projectID, dbName)
+
+	return m.patchSettings(projectID, dbName, &sql.Settings{ActivationPolicy: ActivationPolicyAlways})
+}
+
+// ResizeInstance changes the tier and the data disk size of the database instance.
+// Empty tier or zero diskSizeGb keeps the current value. Note that the disk size cannot be decreased.
+func (m *Manager) ResizeInstance(projectID, dbName, tier string, diskSizeGb int64) error {
+	log.Debugf("ResizeInstance: projectID[%s], db[%s], tier[%s], diskSizeGb[%d]",
+		projectID, dbName, tier, diskSizeGb)
+
+	if tier == "" && diskSizeGb == 0 {
+		return nil
+	}
+
+	return m.patchSettings(projectID, dbName, &sql.Settings{Tier: tier, DataDiskSizeGb: diskSizeGb})
+}
+
+// FailoverInstance fails over the high availability instance to its failover replica.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Failover
+func (m *Manager) FailoverInstance(projectID, dbName string) error {
+	log.Debugf("FailoverInstance: projectID[%s], db[%s]", projectID, dbName)
+
+	dbInstance, err := m.GetDatabase(projectID, dbName)
+	if err != nil {
+		return err
+	}
+
+	request := &sql.InstancesFailoverRequest{
+		FailoverContext: &sql.FailoverContext{SettingsVersion: dbInstance.Settings.SettingsVersion},
+	}
+	op, err := m.Service.Instances.Failover(projectID, dbName, request).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DeleteInstance deletes the database instance and blocks till it's deleted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Delete
+func (m *Manager) DeleteInstance(projectID, dbName string) error {
+	log.Debugf("DeleteInstance: projectID[%s], db[%s]", projectID, dbName)
+
+	op, err := m.Service.Instances.Delete(projectID, dbName).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// patchSettings patches the non-empty fields of settings, which is guarded by the current settings version
+func (m *Manager) patchSettings(projectID, dbName string, settings *sql.Settings) error {
+	dbInstance, err := m.GetDatabase(projectID, dbName)
+	if err != nil {
+		return err
+	}
+	settings.SettingsVersion = dbInstance.Settings.SettingsVersion
+
+	op, err := m.Service.Instances.Patch(projectID, dbName, &sql.DatabaseInstance{Settings: settings}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
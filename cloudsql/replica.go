@@ -0,0 +1,105 @@
+package cloudsql
+
+import (
+	"github.com/iKala/gogoo/gcm"
+
+	log "github.com/cihub/seelog"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// AvailabilityTypeRegional is the availability type of high availability instances
+	AvailabilityTypeRegional = "REGIONAL"
+	// AvailabilityTypeZonal is the availability type of single zone instances
+	AvailabilityTypeZonal = "ZONAL"
+)
+
+// ReplicaStatus is the read replica with its replication lag
+type ReplicaStatus struct {
+	Instance *sql.DatabaseInstance
+	// LagSeconds is the replication lag, -1 if it's unknown
+	LagSeconds float64
+}
+
+// CreateReadReplica creates the read replica of the master instance in the same region and blocks till it's created.
+// Empty tier means the tier of the master instance.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.Insert
+func (m *Manager) CreateReadReplica(projectID, masterName, replicaName, tier string) (*sql.DatabaseInstance, error) {
+	log.Debugf("CreateReadReplica: projectID[%s], master[%s], replica[%s], tier[%s]",
+		projectID, masterName, replicaName, tier)
+
+	master, err := m.GetDatabase(projectID, masterName)
+	if err != nil {
+		return nil, err
+	}
+	if tier == "" {
+		tier = master.Settings.Tier
+	}
+
+	return m.CreateInstance(projectID, &sql.DatabaseInstance{
+		Name:               replicaName,
+		MasterInstanceName: masterName,
+		Region:             master.Region,
+		DatabaseVersion:    master.DatabaseVersion,
+		Settings:           &sql.Settings{Tier: tier},
+	})
+}
+
+// PromoteReplica promotes the read replica to a stand-alone instance and blocks till it's promoted.
+// https://godoc.org/google.golang.org/api/sqladmin/v1beta4#InstancesService.PromoteReplica
+func (m *Manager) PromoteReplica(projectID, replicaName string) error {
+	log.Debugf("PromoteReplica: projectID[%s], replica[%s]", projectID, replicaName)
+
+	op, err := m.Service.Instances.PromoteReplica(projectID, replicaName).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// ListReplicas lists the read replicas of the master instance with their replication lag
+// got from monitor. The lag is -1 if monitor is nil or the lag is unavailable.
+func (m *Manager) ListReplicas(projectID, masterName string, monitor *gcm.Manager) ([]*ReplicaStatus, error) {
+	log.Tracef("ListReplicas: projectID[%s], master[%s]", projectID, masterName)
+
+	master, err := m.GetDatabase(projectID, masterName)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make([]*ReplicaStatus, 0, len(master.ReplicaNames))
+	for _, replicaName := range master.ReplicaNames {
+		replica, err := m.GetDatabase(projectID, replicaName)
+		if err != nil {
+			return nil, err
+		}
+
+		lag := -1.0
+		if monitor != nil {
+			if value, err := monitor.GetCloudSQLReplicationLag(projectID, replicaName); err != nil {
+				log.Warnf("Get replication lag fails: replica[%s], err[%s]", replicaName, err)
+			} else {
+				lag = value
+			}
+		}
+
+		replicas = append(replicas, &ReplicaStatus{Instance: replica, LagSeconds: lag})
+	}
+
+	return replicas, nil
+}
+
+// EnableHA makes the instance highly available with a standby in another zone of the region
+func (m *Manager) EnableHA(projectID, dbName string) error {
+	log.Debugf("EnableHA: projectID[%s], db[%s]", projectID, dbName)
+
+	return m.patchSettings(projectID, dbName, &sql.Settings{AvailabilityType: AvailabilityTypeRegional})
+}
+
+// DisableHA makes the instance run in a single zone
+func (m *Manager) DisableHA(projectID, dbName string) error {
+	log.Debugf("DisableHA: projectID[%s], db[%s]", projectID, dbName)
+
+	return m.patchSettings(projectID, dbName, &sql.Settings{AvailabilityType: AvailabilityTypeZonal})
+}
@@ -0,0 +1,195 @@
+package cloudsql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/iKala/gogoo/gce"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	sql "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// DefaultManagedAclPrefix is the default name prefix of authorized networks managed by AclReconciler
+const DefaultManagedAclPrefix = "gogoo-vm-"
+
+// VMSource selects the VMs whose external IPs are authorized
+type VMSource struct {
+	ProjectID string
+	Zone      string
+	// InstanceGroup selects the VMs in the instance group, Filter is ignored if it's set
+	InstanceGroup string
+	// Filter is the filter of listing VMs, e.g. `name eq web-.*`, empty for all VMs of the zone
+	Filter string
+}
+
+// AclDiff is the difference between the current and the desired authorized networks
+type AclDiff struct {
+	Added   []*sql.AclEntry
+	Removed []*sql.AclEntry
+}
+
+// Empty reports whether nothing needs to be changed
+func (d *AclDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// AclReconciler converges the authorized networks of the database instance to the external IPs
+// of the VMs selected by Sources. The managed entries are named Prefix + VM name,
+// the entries of other names are left untouched.
+type AclReconciler struct {
+	SQL       *Manager
+	Gce       *gce.Manager
+	ProjectID string
+	DBName    string
+	// Prefix is the name prefix of managed entries, DefaultManagedAclPrefix is used if empty
+	Prefix  string
+	Sources []VMSource
+}
+
+// Reconcile adds the entries of new VMs and removes the entries of deleted VMs or changed IPs,
+// and returns the difference. Nothing is written in dry-run mode.
+func (r *AclReconciler) Reconcile(dryRun bool) (*AclDiff, error) {
+	log.Debugf("Reconcile authorized networks: projectID[%s], db[%s], dryRun[%t]", r.ProjectID, r.DBName, dryRun)
+
+	desired, err := r.DesiredEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		current, err := r.SQL.ListAuthorizedNetworks(r.ProjectID, r.DBName)
+		if err != nil {
+			return nil, err
+		}
+		_, diff := diffAclEntries(current, desired, r.prefix())
+		return diff, nil
+	}
+
+	var diff *AclDiff
+	err = r.SQL.modifyAuthorizedNetworks(r.ProjectID, r.DBName, func(current []*sql.AclEntry) ([]*sql.AclEntry, bool) {
+		var next []*sql.AclEntry
+		next, diff = diffAclEntries(current, desired, r.prefix())
+		return next, !diff.Empty()
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Authorized networks reconciled: db[%s], added[%d], removed[%d]",
+		r.DBName, len(diff.Added), len(diff.Removed))
+
+	return diff, nil
+}
+
+// DesiredEntries returns the managed entries of the VMs having external IPs, sorted by name
+func (r *AclReconciler) DesiredEntries() ([]*sql.AclEntry, error) {
+	entries := map[string]*sql.AclEntry{}
+	for _, source := range r.Sources {
+		vms, err := r.listVMs(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list VMs fails: zone[%s], instanceGroup[%s], filter[%s]",
+				source.Zone, source.InstanceGroup, source.Filter)
+		}
+
+		for _, vm := range vms {
+			natIP := r.Gce.GetNatIP(vm)
+			if natIP == "" {
+				log.Debugf("VM without external IP: VM[%s]", vm.Name)
+				continue
+			}
+			name := r.prefix() + vm.Name
+			entries[name] = &sql.AclEntry{Kind: "sql#aclEntry", Name: name, Value: natIP}
+		}
+	}
+
+	result := make([]*sql.AclEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Sort(byAclEntryName(result))
+
+	return result, nil
+}
+
+func (r *AclReconciler) listVMs(source VMSource) ([]*compute.Instance, error) {
+	if source.InstanceGroup != "" {
+		names, err := r.Gce.ListInstancesInInstanceGroup(source.ProjectID, source.Zone, source.InstanceGroup)
+		if err != nil {
+			return nil, err
+		}
+
+		vms := make([]*compute.Instance, 0, len(names))
+		for _, name := range names {
+			vm, err := r.Gce.GetVM(source.ProjectID, source.Zone, name)
+			if err != nil {
+				return nil, err
+			}
+			vms = append(vms, vm)
+		}
+		return vms, nil
+	}
+
+	var list *compute.InstanceList
+	var err error
+	if source.Filter == "" {
+		list, err = r.Gce.ListVMs(source.ProjectID, source.Zone)
+	} else {
+		list, err = r.Gce.ListVMsWithFilter(source.ProjectID, source.Zone, source.Filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+func (r *AclReconciler) prefix() string {
+	if r.Prefix == "" {
+		return DefaultManagedAclPrefix
+	}
+
+	return r.Prefix
+}
+
+// diffAclEntries returns the entries converged to desired, where only the entries of the prefix are managed
+func diffAclEntries(current, desired []*sql.AclEntry, prefix string) ([]*sql.AclEntry, *AclDiff) {
+	diff := &AclDiff{Added: []*sql.AclEntry{}, Removed: []*sql.AclEntry{}}
+
+	wanted := map[string]*sql.AclEntry{}
+	for _, entry := range desired {
+		wanted[entry.Name] = entry
+	}
+
+	next := make([]*sql.AclEntry, 0, len(current)+len(desired))
+	kept := map[string]bool{}
+	for _, entry := range current {
+		if !strings.HasPrefix(entry.Name, prefix) {
+			next = append(next, entry)
+			continue
+		}
+
+		if w, ok := wanted[entry.Name]; ok && !kept[entry.Name] && sameNetwork(w.Value, entry.Value) {
+			next = append(next, entry)
+			kept[entry.Name] = true
+			continue
+		}
+		diff.Removed = append(diff.Removed, entry)
+	}
+
+	for _, entry := range desired {
+		if !kept[entry.Name] {
+			next = append(next, entry)
+			diff.Added = append(diff.Added, entry)
+		}
+	}
+
+	return next, diff
+}
+
+type byAclEntryName []*sql.AclEntry
+
+func (a byAclEntryName) Len() int           { return len(a) }
+func (a byAclEntryName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAclEntryName) Less(i, j int) bool { return a[i].Name < a[j].Name }
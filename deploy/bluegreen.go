@@ -0,0 +1,322 @@
+package deploy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iKala/gogoo/gce"
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// Steps of the blue/green deployment in order
+const (
+	StepStarted         = "started"
+	StepTemplateCreated = "template_created"
+	StepGroupCreated    = "group_created"
+	StepGroupHealthy    = "group_healthy"
+	StepShifted         = "shifted"
+	StepRolledBack      = "rolled_back"
+	StepFinalized       = "finalized"
+)
+
+const (
+	// DefaultHealthTimeout is the default timeout of the green group becoming healthy
+	DefaultHealthTimeout = 10 * time.Minute
+	// healthPollingInterval is the interval of polling the instances of the green group
+	healthPollingInterval = 10 * time.Second
+
+	instanceStatusRunning = "RUNNING"
+	instanceActionNone    = "NONE"
+)
+
+var stepOrder = map[string]int{
+	StepStarted:         0,
+	StepTemplateCreated: 1,
+	StepGroupCreated:    2,
+	StepGroupHealthy:    3,
+	StepShifted:         4,
+}
+
+// BlueGreen is the spec of the blue/green deployment, which brings up the green group from a new
+// template derived from the base template, and shifts the target pool from the blue group to it.
+// The target pool is set on the groups, so the instances recreated by them stay in the right pool.
+// The blue group is kept for RollbackBlueGreen till FinalizeBlueGreen.
+type BlueGreen struct {
+	// Name identifies the deployment and its state
+	Name      string
+	ProjectID string
+	Zone      string
+	Region    string
+
+	BaseTemplate string
+	// Template is the name of the new template
+	Template string
+	// Image is the source image of the boot disk, empty to keep the image of the base template
+	Image string
+	// MachineType is empty to keep the machine type of the base template
+	MachineType string
+	// Metadata is merged into the metadata of the base template
+	Metadata map[string]string
+
+	BlueGroup  string
+	GreenGroup string
+	Size       int64
+	TargetPool string
+
+	// HealthCheck checks every green instance, nil means running is healthy
+	HealthCheck gce.VMConditionChecker
+	// HealthTimeout is DefaultHealthTimeout if zero
+	HealthTimeout time.Duration
+}
+
+func (spec *BlueGreen) validate() error {
+	if spec.Name == "" || spec.ProjectID == "" || spec.Zone == "" || spec.Region == "" ||
+		spec.BaseTemplate == "" || spec.Template == "" || spec.BlueGroup == "" ||
+		spec.GreenGroup == "" || spec.TargetPool == "" || spec.Size <= 0 {
+		return errors.Errorf("incomplete blue/green spec: %+v", spec)
+	}
+	if spec.BlueGroup == spec.GreenGroup {
+		return errors.Errorf("blue and green groups should be different: group[%s]", spec.BlueGroup)
+	}
+
+	return nil
+}
+
+// DeployBlueGreen runs the deployment from the last finished step. It's a no-op if
+// the deployment has been shifted, rolled back or finalized.
+func (d *Deployer) DeployBlueGreen(spec *BlueGreen) (*State, error) {
+	log.Infof("DeployBlueGreen: name[%s], template[%s], green[%s]", spec.Name, spec.Template, spec.GreenGroup)
+
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	state, err := d.LoadState(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &State{
+			Name:       spec.Name,
+			Step:       StepStarted,
+			Template:   spec.Template,
+			BlueGroup:  spec.BlueGroup,
+			GreenGroup: spec.GreenGroup,
+		}
+		if err := d.saveState(state); err != nil {
+			return nil, err
+		}
+	}
+	if state.Template != spec.Template || state.GreenGroup != spec.GreenGroup {
+		return state, errors.Errorf("deployment exists with another template or group: name[%s], template[%s], green[%s]",
+			spec.Name, state.Template, state.GreenGroup)
+	}
+
+	steps := []struct {
+		step string
+		run  func(*BlueGreen, *State) error
+	}{
+		{StepTemplateCreated, d.createTemplate},
+		{StepGroupCreated, d.createGreenGroup},
+		{StepGroupHealthy, d.waitGreenHealthy},
+		{StepShifted, d.shiftTargetPool},
+	}
+	for _, s := range steps {
+		order, ok := stepOrder[state.Step]
+		if !ok || order >= stepOrder[s.step] {
+			continue
+		}
+
+		if err := s.run(spec, state); err != nil {
+			return state, d.fail(state, errors.Wrapf(err, "step[%s]", s.step))
+		}
+		state.Step = s.step
+		state.Error = ""
+		if err := d.saveState(state); err != nil {
+			return state, err
+		}
+	}
+
+	return state, nil
+}
+
+// RollbackBlueGreen shifts the target pool back to the blue group. The green group is kept for inspection.
+func (d *Deployer) RollbackBlueGreen(spec *BlueGreen) (*State, error) {
+	log.Infof("RollbackBlueGreen: name[%s]", spec.Name)
+
+	state, err := d.LoadState(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.Errorf("deployment not found: name[%s]", spec.Name)
+	}
+	if state.Step == StepFinalized {
+		return state, errors.Errorf("deployment has been finalized: name[%s]", spec.Name)
+	}
+
+	if err := d.setGroupTargetPool(spec, state.BlueGroup, true); err != nil {
+		return state, d.fail(state, err)
+	}
+	if _, err := d.Gce.GetInstanceGroupManager(spec.ProjectID, spec.Zone, state.GreenGroup); err != nil {
+		// the green group may not have been created
+		log.Warnf("Get green group fails: group[%s], err[%s]", state.GreenGroup, err)
+	} else if err := d.setGroupTargetPool(spec, state.GreenGroup, false); err != nil {
+		return state, d.fail(state, err)
+	}
+
+	state.Step = StepRolledBack
+	state.Error = ""
+	return state, d.saveState(state)
+}
+
+// FinalizeBlueGreen deletes the blue group after the deployment is shifted, which cannot be rolled back then
+func (d *Deployer) FinalizeBlueGreen(spec *BlueGreen) (*State, error) {
+	log.Infof("FinalizeBlueGreen: name[%s]", spec.Name)
+
+	state, err := d.LoadState(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.Errorf("deployment not found: name[%s]", spec.Name)
+	}
+	if state.Step == StepFinalized {
+		return state, nil
+	}
+	if state.Step != StepShifted {
+		return state, errors.Errorf("deployment is not shifted: name[%s], step[%s]", spec.Name, state.Step)
+	}
+
+	if _, err := d.Gce.GetInstanceGroupManager(spec.ProjectID, spec.Zone, state.BlueGroup); err == nil {
+		if err := d.Gce.DeleteInstanceGroupManager(spec.ProjectID, spec.Zone, state.BlueGroup); err != nil {
+			return state, d.fail(state, err)
+		}
+	}
+
+	state.Step = StepFinalized
+	state.Error = ""
+	return state, d.saveState(state)
+}
+
+func (d *Deployer) createTemplate(spec *BlueGreen, state *State) error {
+	if _, err := d.Gce.GetInstanceTemplate(spec.ProjectID, spec.Template); err == nil {
+		log.Debugf("Template exists: template[%s]", spec.Template)
+		return nil
+	}
+
+	_, err := d.Gce.DeriveInstanceTemplate(spec.ProjectID, spec.BaseTemplate, spec.Template, &gce.TemplateOverrides{
+		Image:       spec.Image,
+		MachineType: spec.MachineType,
+		Metadata:    spec.Metadata,
+	})
+	return err
+}
+
+func (d *Deployer) createGreenGroup(spec *BlueGreen, state *State) error {
+	if _, err := d.Gce.GetInstanceGroupManager(spec.ProjectID, spec.Zone, spec.GreenGroup); err == nil {
+		log.Debugf("Green group exists: group[%s]", spec.GreenGroup)
+		return nil
+	}
+
+	return d.Gce.NewInstanceGroupManager(spec.ProjectID, spec.Zone, &compute.InstanceGroupManager{
+		Name:             spec.GreenGroup,
+		BaseInstanceName: spec.GreenGroup,
+		InstanceTemplate: templateURL(spec.ProjectID, spec.Template),
+		TargetSize:       spec.Size,
+	})
+}
+
+// waitGreenHealthy waits till all green instances are running and pass the health check
+func (d *Deployer) waitGreenHealthy(spec *BlueGreen, state *State) error {
+	timeout := spec.HealthTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	healthy := map[string]bool{}
+	startTime := time.Now()
+	for {
+		if time.Now().Sub(startTime) > timeout {
+			return errors.Errorf("green group not healthy in time: group[%s], healthy[%d/%d]",
+				spec.GreenGroup, len(healthy), spec.Size)
+		}
+
+		instances, err := d.Gce.ListManagedInstances(spec.ProjectID, spec.Zone, spec.GreenGroup)
+		if err != nil {
+			log.Warnf("List green instances fails: group[%s], err[%s]", spec.GreenGroup, err)
+			time.Sleep(healthPollingInterval)
+			continue
+		}
+
+		names := []string{}
+		for _, mi := range instances {
+			name := formatutil.GetLastSplit(mi.Instance, "/")
+			if mi.InstanceStatus != instanceStatusRunning || mi.CurrentAction != instanceActionNone {
+				continue
+			}
+			if !healthy[name] && spec.HealthCheck != nil {
+				ok, err := spec.HealthCheck(spec.ProjectID, spec.Zone, name)
+				if err != nil || !ok {
+					log.Debugf("Green instance not healthy yet: instance[%s], err[%v]", name, err)
+					continue
+				}
+			}
+			healthy[name] = true
+			names = append(names, name)
+		}
+
+		if int64(len(names)) >= spec.Size {
+			state.GreenInstances = names
+			return nil
+		}
+		time.Sleep(healthPollingInterval)
+	}
+}
+
+// shiftTargetPool adds the target pool to the green group before removing it from the blue group
+func (d *Deployer) shiftTargetPool(spec *BlueGreen, state *State) error {
+	if err := d.setGroupTargetPool(spec, state.GreenGroup, true); err != nil {
+		return err
+	}
+
+	return d.setGroupTargetPool(spec, state.BlueGroup, false)
+}
+
+// setGroupTargetPool adds or removes the target pool of the managed instance group, and skips
+// the group which has been done
+func (d *Deployer) setGroupTargetPool(spec *BlueGreen, group string, attached bool) error {
+	igm, err := d.Gce.GetInstanceGroupManager(spec.ProjectID, spec.Zone, group)
+	if err != nil {
+		return err
+	}
+
+	pool := fmt.Sprintf("projects/%s/regions/%s/targetPools/%s", spec.ProjectID, spec.Region, spec.TargetPool)
+	pools := withTargetPool(igm.TargetPools, pool, attached)
+	if len(pools) == len(igm.TargetPools) {
+		log.Debugf("Target pool set: group[%s], pool[%s], attached[%t]", group, spec.TargetPool, attached)
+		return nil
+	}
+
+	return d.Gce.SetInstanceGroupManagerTargetPools(spec.ProjectID, spec.Zone, group, pools)
+}
+
+// withTargetPool returns the target pools with or without the pool, which are compared by name
+func withTargetPool(pools []string, pool string, attached bool) []string {
+	name := formatutil.GetLastSplit(pool, "/")
+	result := []string{}
+	for _, p := range pools {
+		if formatutil.GetLastSplit(p, "/") != name {
+			result = append(result, p)
+		}
+	}
+	if attached {
+		result = append(result, pool)
+	}
+
+	return result
+}
@@ -0,0 +1,361 @@
+package deploy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iKala/gogoo/gcm"
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	compute "google.golang.org/api/compute/v0.beta"
+)
+
+// Steps of the canary deployment in order, the deployment ends with StepPromoted or StepRolledBack
+const (
+	StepCanaryStarted = "canary_started"
+	StepCanaryReady   = "canary_ready"
+	StepBaked         = "baked"
+	StepPromoted      = "promoted"
+)
+
+const (
+	// DefaultBakeTime is the default time of comparing the metrics of canary and baseline
+	DefaultBakeTime = 30 * time.Minute
+	// DefaultBakeInterval is the default interval of comparing the metrics
+	DefaultBakeInterval = 5 * time.Minute
+	// DefaultCanaryReadyTimeout is the default timeout of the canary instances becoming running
+	DefaultCanaryReadyTimeout = 10 * time.Minute
+
+	// InstanceNameLabel is the label of the instance name of compute metrics
+	InstanceNameLabel = "metric.label.instance_name"
+	// CPUUtilizationMetric is the metric type of the CPU utilization of instances
+	CPUUtilizationMetric = "compute.googleapis.com/instance/cpu/utilization"
+
+	baselineVersion = "baseline"
+	canaryVersion   = "canary"
+)
+
+// ErrCanaryFailed is the cause of the error returned when the canary is rolled back by metrics
+var ErrCanaryFailed = errors.New("canary failed")
+
+var canaryStepOrder = map[string]int{
+	StepStarted:       0,
+	StepCanaryStarted: 1,
+	StepCanaryReady:   2,
+	StepBaked:         3,
+	StepPromoted:      4,
+}
+
+// MetricComparison compares the mean of the metric of canary instances to the baseline instances.
+// The canary fails if canary > baseline * MaxRatio + Slack, e.g. MaxRatio 1.2 and Slack 0.01 for error rate.
+type MetricComparison struct {
+	MetricType string
+	// InstanceLabel is InstanceNameLabel if empty, custom metrics may use another label
+	InstanceLabel string
+	// MaxRatio should be positive, e.g. 1 for no worse than baseline
+	MaxRatio float64
+	Slack    float64
+}
+
+// Canary is the spec of the canary deployment, which updates some instances of the managed instance group
+// to the new template, compares their metrics to the rest during the bake time, and promotes the template
+// to all instances or rolls back automatically.
+type Canary struct {
+	// Name identifies the deployment and its state
+	Name                 string
+	ProjectID            string
+	Zone                 string
+	InstanceGroupManager string
+	// Template is the name of the new template
+	Template string
+	// CanarySize is the fixed number or the percentage of the canary instances
+	CanarySize *compute.FixedOrPercent
+
+	// BakeTime is DefaultBakeTime if zero
+	BakeTime time.Duration
+	// BakeInterval is DefaultBakeInterval if zero
+	BakeInterval time.Duration
+	// ReadyTimeout is DefaultCanaryReadyTimeout if zero
+	ReadyTimeout time.Duration
+	Metrics      []MetricComparison
+}
+
+func (spec *Canary) validate() error {
+	if spec.Name == "" || spec.ProjectID == "" || spec.Zone == "" ||
+		spec.InstanceGroupManager == "" || spec.Template == "" || spec.CanarySize == nil {
+		return errors.Errorf("incomplete canary spec: %+v", spec)
+	}
+	for i, mc := range spec.Metrics {
+		if mc.MetricType == "" || mc.MaxRatio <= 0 {
+			return errors.Errorf("invalid canary metrics[%d]: %+v", i, mc)
+		}
+	}
+
+	return nil
+}
+
+// DeployCanary runs the canary deployment from the last finished step. The error caused by ErrCanaryFailed
+// is returned if the canary is rolled back. It's a no-op if the deployment has been promoted or rolled back.
+func (d *Deployer) DeployCanary(spec *Canary) (*State, error) {
+	log.Infof("DeployCanary: name[%s], igm[%s], template[%s]", spec.Name, spec.InstanceGroupManager, spec.Template)
+
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	state, err := d.LoadState(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.Get
+		igm, err := d.Mig.Service.InstanceGroupManagers.Get(spec.ProjectID, spec.Zone, spec.InstanceGroupManager).Do()
+		if err != nil {
+			return nil, err
+		}
+		baseline := igm.InstanceTemplate
+		if baseline == "" && len(igm.Versions) > 0 {
+			baseline = igm.Versions[0].InstanceTemplate
+		}
+		state = &State{
+			Name:             spec.Name,
+			Step:             StepStarted,
+			Template:         spec.Template,
+			GreenGroup:       spec.InstanceGroupManager,
+			BaselineTemplate: baseline,
+		}
+		if err := d.saveState(state); err != nil {
+			return nil, err
+		}
+	}
+	if state.Template != spec.Template || state.GreenGroup != spec.InstanceGroupManager {
+		return state, errors.Errorf("deployment exists with another template or group: name[%s], template[%s], igm[%s]",
+			spec.Name, state.Template, state.GreenGroup)
+	}
+
+	steps := []struct {
+		step string
+		run  func(*Canary, *State) error
+	}{
+		{StepCanaryStarted, d.startCanary},
+		{StepCanaryReady, d.waitCanaryReady},
+		{StepBaked, d.bakeCanary},
+		{StepPromoted, d.promoteCanary},
+	}
+	for _, s := range steps {
+		order, ok := canaryStepOrder[state.Step]
+		if !ok || order >= canaryStepOrder[s.step] {
+			continue
+		}
+
+		err := s.run(spec, state)
+		if errors.Cause(err) == ErrCanaryFailed {
+			return state, d.rollbackCanary(spec, state, err)
+		}
+		if err != nil {
+			return state, d.fail(state, errors.Wrapf(err, "step[%s]", s.step))
+		}
+		state.Step = s.step
+		state.Error = ""
+		if err := d.saveState(state); err != nil {
+			return state, err
+		}
+	}
+
+	return state, nil
+}
+
+// RollbackCanary updates all instances of the group back to the baseline template
+func (d *Deployer) RollbackCanary(spec *Canary) (*State, error) {
+	log.Infof("RollbackCanary: name[%s]", spec.Name)
+
+	state, err := d.LoadState(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.Errorf("deployment not found: name[%s]", spec.Name)
+	}
+
+	return state, d.rollbackCanary(spec, state, nil)
+}
+
+// rollbackCanary rolls back and records the cause, which is returned
+func (d *Deployer) rollbackCanary(spec *Canary, state *State, cause error) error {
+	if err := d.setVersions(spec, []*compute.InstanceGroupManagerVersion{
+		{Name: d.versionName(spec, baselineVersion), InstanceTemplate: state.BaselineTemplate},
+	}); err != nil {
+		return d.fail(state, errors.Wrap(err, "rollback fails"))
+	}
+
+	state.Step = StepRolledBack
+	state.Error = ""
+	if cause != nil {
+		state.Error = cause.Error()
+	}
+	if err := d.saveState(state); err != nil {
+		return err
+	}
+
+	return cause
+}
+
+func (d *Deployer) startCanary(spec *Canary, state *State) error {
+	return d.setVersions(spec, []*compute.InstanceGroupManagerVersion{
+		{Name: d.versionName(spec, baselineVersion), InstanceTemplate: state.BaselineTemplate},
+		{
+			Name:             d.versionName(spec, canaryVersion),
+			InstanceTemplate: templateURL(spec.ProjectID, spec.Template),
+			TargetSize:       spec.CanarySize,
+		},
+	})
+}
+
+// waitCanaryReady waits till the group is stable with running canary instances
+func (d *Deployer) waitCanaryReady(spec *Canary, state *State) error {
+	timeout := spec.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultCanaryReadyTimeout
+	}
+
+	startTime := time.Now()
+	for {
+		if time.Now().Sub(startTime) > timeout {
+			return errors.Errorf("canary not ready in time: igm[%s]", spec.InstanceGroupManager)
+		}
+
+		status, err := d.Mig.Get(spec.ProjectID, spec.Zone, spec.InstanceGroupManager)
+		if err == nil && status.Stable {
+			canary, _, err := d.partitionInstances(spec)
+			if err == nil && len(canary) > 0 {
+				return nil
+			}
+		}
+
+		time.Sleep(healthPollingInterval)
+	}
+}
+
+// bakeCanary compares the metrics every interval till the bake time passes, which resumes
+// from the recorded start time of baking
+func (d *Deployer) bakeCanary(spec *Canary, state *State) error {
+	bakeTime := spec.BakeTime
+	if bakeTime <= 0 {
+		bakeTime = DefaultBakeTime
+	}
+	interval := spec.BakeInterval
+	if interval <= 0 {
+		interval = DefaultBakeInterval
+	}
+
+	if state.BakeStartedAt.IsZero() {
+		state.BakeStartedAt = time.Now()
+		if err := d.saveState(state); err != nil {
+			return err
+		}
+	}
+
+	for {
+		time.Sleep(interval)
+
+		canary, baseline, err := d.partitionInstances(spec)
+		if err != nil {
+			return err
+		}
+		if err := d.compareMetrics(spec, canary, baseline, interval); err != nil {
+			return err
+		}
+
+		if time.Now().Sub(state.BakeStartedAt) >= bakeTime {
+			return nil
+		}
+	}
+}
+
+func (d *Deployer) promoteCanary(spec *Canary, state *State) error {
+	return d.setVersions(spec, []*compute.InstanceGroupManagerVersion{
+		{Name: d.versionName(spec, canaryVersion), InstanceTemplate: templateURL(spec.ProjectID, spec.Template)},
+	})
+}
+
+// compareMetrics returns the error caused by ErrCanaryFailed if any metric of the canary is worse.
+// The metrics without data are skipped.
+func (d *Deployer) compareMetrics(spec *Canary, canary, baseline []string, window time.Duration) error {
+	for _, mc := range spec.Metrics {
+		label := mc.InstanceLabel
+		if label == "" {
+			label = InstanceNameLabel
+		}
+
+		canaryMean, err := d.Monitor.GetMeanOfInstances(spec.ProjectID, mc.MetricType, label, canary, window)
+		if err == gcm.ErrNoTimeSeries {
+			log.Debugf("No canary data: metric[%s]", mc.MetricType)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		baselineMean, err := d.Monitor.GetMeanOfInstances(spec.ProjectID, mc.MetricType, label, baseline, window)
+		if err == gcm.ErrNoTimeSeries {
+			log.Debugf("No baseline data: metric[%s]", mc.MetricType)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Debugf("Canary metric: metric[%s], canary[%f], baseline[%f]", mc.MetricType, canaryMean, baselineMean)
+		if canaryMean > baselineMean*mc.MaxRatio+mc.Slack {
+			return errors.Wrapf(ErrCanaryFailed, "metric[%s], canary[%f], baseline[%f]",
+				mc.MetricType, canaryMean, baselineMean)
+		}
+	}
+
+	return nil
+}
+
+// partitionInstances returns the names of running canary and baseline instances
+func (d *Deployer) partitionInstances(spec *Canary) ([]string, []string, error) {
+	// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.ListManagedInstances
+	res, err := d.Mig.Service.InstanceGroupManagers.ListManagedInstances(
+		spec.ProjectID, spec.Zone, spec.InstanceGroupManager).Do()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	canary, baseline := []string{}, []string{}
+	for _, mi := range res.ManagedInstances {
+		if mi.InstanceStatus != instanceStatusRunning || mi.CurrentAction != instanceActionNone || mi.Version == nil {
+			continue
+		}
+
+		name := formatutil.GetLastSplit(mi.Instance, "/")
+		switch mi.Version.Name {
+		case d.versionName(spec, canaryVersion):
+			canary = append(canary, name)
+		case d.versionName(spec, baselineVersion):
+			baseline = append(baseline, name)
+		}
+	}
+
+	return canary, baseline, nil
+}
+
+func (d *Deployer) setVersions(spec *Canary, versions []*compute.InstanceGroupManagerVersion) error {
+	op, err := d.Mig.SetVersions(spec.ProjectID, spec.Zone, spec.InstanceGroupManager, versions)
+	if err != nil {
+		return err
+	}
+
+	return d.Mig.WaitOperation(spec.ProjectID, op)
+}
+
+func (d *Deployer) versionName(spec *Canary, version string) string {
+	return fmt.Sprintf("%s-%s", spec.Name, version)
+}
+
+func templateURL(projectID, template string) string {
+	return fmt.Sprintf("projects/%s/global/instanceTemplates/%s", projectID, template)
+}
@@ -0,0 +1,89 @@
+// Package deploy orchestrates deployments on compute engine. The state of every deployment
+// is kept in datastore after each step, so that an interrupted deployment resumes from the last step.
+package deploy
+
+import (
+	"time"
+
+	"github.com/iKala/gogoo/gce"
+	"github.com/iKala/gogoo/gcm"
+	"github.com/iKala/gogoo/gds"
+	"github.com/iKala/gogoo/replicapoolupdater"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/cloud/datastore"
+)
+
+// DeploymentKind is the kind of entities keeping the state of deployments
+const DeploymentKind = "GogooDeployment"
+
+// Deployer runs deployments with the managers of compute engine, managed instance groups, monitoring and datastore
+type Deployer struct {
+	Gce     *gce.Manager                   `inject:""`
+	Mig     *replicapoolupdater.MigManager `inject:""`
+	Gds     *gds.Manager                   `inject:""`
+	Monitor *gcm.Manager                   `inject:""`
+}
+
+// State is the state of the deployment keyed by its name
+type State struct {
+	Name string `datastore:"-"`
+	// Step is the last finished step
+	Step     string `datastore:"step"`
+	Template string `datastore:"template,noindex"`
+	// BlueGroup serves the traffic before the deployment, and GreenGroup after it
+	BlueGroup      string   `datastore:"blue_group,noindex"`
+	GreenGroup     string   `datastore:"green_group,noindex"`
+	GreenInstances []string `datastore:"green_instances,noindex"`
+	// BaselineTemplate is the template of the instance group before the canary deployment
+	BaselineTemplate string    `datastore:"baseline_template,noindex"`
+	BakeStartedAt    time.Time `datastore:"bake_started_at,noindex"`
+	// Error is the error of the last failed run
+	Error     string    `datastore:"error,noindex"`
+	UpdatedAt time.Time `datastore:"updated_at"`
+}
+
+// LoadState loads the state of the deployment, nil if the deployment has never run
+func (d *Deployer) LoadState(name string) (*State, error) {
+	state := &State{}
+	if err := d.Gds.Get(d.stateKey(name), state); err != nil {
+		if errors.Cause(err) == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state.Name = name
+
+	return state, nil
+}
+
+// DeleteState deletes the state of the deployment, so that the name could be reused
+func (d *Deployer) DeleteState(name string) error {
+	return d.Gds.Delete(d.stateKey(name))
+}
+
+func (d *Deployer) saveState(state *State) error {
+	log.Debugf("Deployment state: name[%s], step[%s], error[%s]", state.Name, state.Step, state.Error)
+
+	state.UpdatedAt = time.Now()
+	if _, err := d.Gds.Put(d.stateKey(state.Name), state); err != nil {
+		return errors.Wrapf(err, "save deployment state fails: name[%s]", state.Name)
+	}
+
+	return nil
+}
+
+// fail records the error into the state and returns it
+func (d *Deployer) fail(state *State, err error) error {
+	state.Error = err.Error()
+	if saveErr := d.saveState(state); saveErr != nil {
+		log.Warnf("Save failed state fails: name[%s], err[%s]", state.Name, saveErr)
+	}
+
+	return err
+}
+
+func (d *Deployer) stateKey(name string) *datastore.Key {
+	return d.Gds.BuildKey(DeploymentKind+d.Gds.SuffixOfKind, name)
+}
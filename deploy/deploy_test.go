@@ -0,0 +1,185 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iKala/gogoo/config"
+	"github.com/iKala/gogoo/gce"
+	"github.com/iKala/gogoo/gcm"
+	"github.com/iKala/gogoo/gds"
+	"github.com/iKala/gogoo/replicapoolupdater"
+
+	"github.com/facebookgo/inject"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	compute "google.golang.org/api/compute/v0.beta"
+)
+
+var tested Deployer
+var testedProjectID string
+var testedZone = "asia-east1-b"
+var testedRegion = "asia-east1"
+
+/*
+ * Prepare below resources before running test
+ */
+var baseTemplateName = "instance-template-test"
+var blueGroupName = "instance-group-manager-test"
+var targetPoolName = "target-pool-test"
+
+func TestDeployerTestSuite(t *testing.T) {
+	suite.Run(t, new(DeployerTestSuite))
+}
+
+type DeployerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *DeployerTestSuite) SetupSuite() {
+	gcloudConfig := config.LoadGcloudConfig(config.LoadAsset("/config/config.json"))
+	key, _ := ioutil.ReadAll(config.LoadAsset("/config/key.pem"))
+
+	testedProjectID = gcloudConfig.ProjectID
+
+	// Construct dependency graph
+	computeService, _ := gce.BuildGceService(gcloudConfig.ServiceAccount, key)
+	_, client, _ := gds.BuildGdsContext(gcloudConfig.ServiceAccount, key, gcloudConfig.ProjectID)
+	monitorService, _ := gcm.BuildCloudMonitorService(gcloudConfig.ServiceAccount, key)
+	migService, _ := replicapoolupdater.BuildMigService(gcloudConfig.ServiceAccount, key)
+
+	var g inject.Graph
+	err := g.Provide(
+		&inject.Object{Value: computeService},
+		&inject.Object{Value: client},
+		&inject.Object{Value: monitorService},
+		&inject.Object{Value: migService},
+		&inject.Object{Value: &gce.Manager{}},
+		&inject.Object{Value: &gds.Manager{}},
+		&inject.Object{Value: &gcm.Manager{}},
+		&inject.Object{Value: &replicapoolupdater.MigManager{}},
+		&inject.Object{Value: &tested},
+	)
+	if err != nil {
+		os.Exit(1)
+	}
+	if err := g.Populate(); err != nil {
+		os.Exit(1)
+	}
+	// :~)
+
+	log.Println("======== SetupSuite  ========")
+}
+
+func (suite *DeployerTestSuite) Test_BlueGreen() {
+	if testing.Short() {
+		suite.T().Skip("deployment takes minutes")
+	}
+
+	suffix := time.Now().Unix()
+	spec := &BlueGreen{
+		Name:         fmt.Sprintf("deploy-test-%d", suffix),
+		ProjectID:    testedProjectID,
+		Zone:         testedZone,
+		Region:       testedRegion,
+		BaseTemplate: baseTemplateName,
+		Template:     fmt.Sprintf("%s-%d", baseTemplateName, suffix),
+		Metadata:     map[string]string{"version": fmt.Sprint(suffix)},
+		BlueGroup:    blueGroupName,
+		GreenGroup:   fmt.Sprintf("green-test-%d", suffix),
+		Size:         1,
+		TargetPool:   targetPoolName,
+	}
+	defer tested.DeleteState(spec.Name)
+	defer tested.Gce.DeleteInstanceTemplate(testedProjectID, spec.Template)
+	defer tested.Gce.DeleteInstanceGroupManager(testedProjectID, testedZone, spec.GreenGroup)
+
+	state, err := tested.DeployBlueGreen(spec)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StepShifted, state.Step)
+	assert.Equal(suite.T(), 1, len(state.GreenInstances))
+
+	// resuming a shifted deployment is a no-op
+	state, err = tested.DeployBlueGreen(spec)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StepShifted, state.Step)
+
+	state, err = tested.RollbackBlueGreen(spec)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StepRolledBack, state.Step)
+}
+
+func (suite *DeployerTestSuite) Test_WithTargetPool() {
+	pool := "projects/gogoo/regions/asia-east1/targetPools/web"
+	other := "https://www.googleapis.com/compute/v1/projects/gogoo/regions/asia-east1/targetPools/api"
+	attached := "https://www.googleapis.com/compute/v1/projects/gogoo/regions/asia-east1/targetPools/web"
+
+	assert.Equal(suite.T(), []string{other, pool}, withTargetPool([]string{other}, pool, true))
+	assert.Equal(suite.T(), []string{other, pool}, withTargetPool([]string{other, attached}, pool, true))
+	assert.Equal(suite.T(), []string{other}, withTargetPool([]string{attached, other}, pool, false))
+	assert.Equal(suite.T(), []string{}, withTargetPool(nil, pool, false))
+}
+
+func (suite *DeployerTestSuite) Test_CanaryValidate() {
+	valid := func() *Canary {
+		return &Canary{
+			Name:                 "canary-test",
+			ProjectID:            "gogoo",
+			Zone:                 testedZone,
+			InstanceGroupManager: blueGroupName,
+			Template:             baseTemplateName,
+			CanarySize:           &compute.FixedOrPercent{Fixed: 1},
+			Metrics: []MetricComparison{
+				{MetricType: CPUUtilizationMetric, MaxRatio: 1.5, Slack: 0.1},
+			},
+		}
+	}
+	assert.Nil(suite.T(), valid().validate())
+
+	invalids := []func(spec *Canary){
+		func(spec *Canary) { spec.CanarySize = nil },
+		func(spec *Canary) { spec.Metrics[0].MaxRatio = 0 },
+		func(spec *Canary) { spec.Metrics[0].MaxRatio = -1 },
+		func(spec *Canary) { spec.Metrics[0].MetricType = "" },
+	}
+	for i, invalidate := range invalids {
+		spec := valid()
+		invalidate(spec)
+		assert.NotNil(suite.T(), spec.validate(), "invalid[%d]", i)
+	}
+}
+
+func (suite *DeployerTestSuite) Test_Canary() {
+	if testing.Short() {
+		suite.T().Skip("deployment takes minutes")
+	}
+
+	suffix := time.Now().Unix()
+	spec := &Canary{
+		Name:                 fmt.Sprintf("canary-test-%d", suffix),
+		ProjectID:            testedProjectID,
+		Zone:                 testedZone,
+		InstanceGroupManager: blueGroupName,
+		Template:             baseTemplateName,
+		CanarySize:           &compute.FixedOrPercent{Fixed: 1},
+		BakeTime:             2 * time.Minute,
+		BakeInterval:         time.Minute,
+		Metrics: []MetricComparison{
+			{MetricType: CPUUtilizationMetric, MaxRatio: 1.5, Slack: 0.1},
+		},
+	}
+	defer tested.DeleteState(spec.Name)
+
+	state, err := tested.DeployCanary(spec)
+	if errors.Cause(err) == ErrCanaryFailed {
+		assert.Equal(suite.T(), StepRolledBack, state.Step)
+		return
+	}
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StepPromoted, state.Step)
+}
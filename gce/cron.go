@@ -0,0 +1,125 @@
+package gce
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CronSchedule is the schedule of the standard 5-field cron expression `minute hour day-of-month month day-of-week`.
+// Fields support `*`, lists `1,15`, ranges `1-5` and steps `*/10` or `0-30/5`, and day-of-week 0 or 7 is Sunday.
+// As cron does, a time matches either day field if both of them are restricted.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// cronSearchLimit bounds the search of the next time, e.g. `0 0 30 2 *` never matches
+const cronSearchLimit = 5 * 366 * 24 * 60
+
+// ParseCronSchedule parses the 5-field cron expression
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expression needs 5 fields: expr[%s]", expr)
+	}
+
+	s := &CronSchedule{}
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		bits, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad cron field[%s]: expr[%s]", fields[i], expr)
+		}
+		*b.field = bits
+	}
+
+	// Sunday is 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("bad step[%s]", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("bad value[%s]", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("bad value[%s]", part)
+				}
+			} else if step > 1 {
+				// `5/10` means from 5 to max every 10
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Errorf("out of range[%d-%d]: value[%s]", min, max, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first matched minute after t, zero if no time matches within years
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < cronSearchLimit; i++ {
+		if s.matches(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) matches(t time.Time) bool {
+	has := func(bits uint64, v int) bool { return bits&(1<<uint(v)) != 0 }
+
+	if !has(s.minute, t.Minute()) || !has(s.hour, t.Hour()) || !has(s.month, int(t.Month())) {
+		return false
+	}
+
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
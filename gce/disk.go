@@ -0,0 +1,230 @@
+package gce
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// DiskTypeSSD ...
+	DiskTypeSSD = "pd-ssd"
+	// DiskTypeStandard ...
+	DiskTypeStandard = "pd-standard"
+
+	// DiskModeReadWrite ...
+	DiskModeReadWrite = "READ_WRITE"
+	// DiskModeReadOnly ...
+	DiskModeReadOnly = "READ_ONLY"
+)
+
+// DiskOptions is the options of new disks
+type DiskOptions struct {
+	// SizeGb is the size of the image or the snapshot if zero
+	SizeGb int64
+	// Type is the name or the URL of the disk type, e.g. DiskTypeSSD, the zone default if empty
+	Type string
+	// SourceImage and SourceSnapshot are empty for a blank disk
+	SourceImage    string
+	SourceSnapshot string
+	Labels         map[string]string
+	Description    string
+}
+
+// AttachDiskOptions is the options of attaching disks to VMs
+type AttachDiskOptions struct {
+	// DeviceName is the name in /dev/disk/by-id/google-*, the disk name if empty
+	DeviceName string
+	// Mode is DiskModeReadWrite if empty
+	Mode       string
+	AutoDelete bool
+}
+
+// NewDiskWithOptions creates the disk, blank or from the image or the snapshot, and blocks till it's created
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.Insert
+func (m *Manager) NewDiskWithOptions(projectID, zone, name string, options *DiskOptions) (*compute.Disk, error) {
+	log.Debugf("NewDiskWithOptions: project[%s], zone[%s], disk[%s], options[%+v]", projectID, zone, name, options)
+
+	if options == nil {
+		options = &DiskOptions{}
+	}
+	if options.SourceImage != "" && options.SourceSnapshot != "" {
+		return nil, errors.Errorf("disk from both image and snapshot: disk[%s]", name)
+	}
+	if options.SourceImage == "" && options.SourceSnapshot == "" && options.SizeGb <= 0 {
+		return nil, errors.Errorf("blank disk without size: disk[%s]", name)
+	}
+
+	disk := &compute.Disk{
+		Name:           name,
+		SizeGb:         options.SizeGb,
+		SourceImage:    options.SourceImage,
+		SourceSnapshot: options.SourceSnapshot,
+		Labels:         options.Labels,
+		Description:    options.Description,
+	}
+	if options.Type != "" {
+		disk.Type = options.Type
+		if !strings.Contains(disk.Type, "/") {
+			disk.Type = fmt.Sprintf("zones/%s/diskTypes/%s", zone, options.Type)
+		}
+	}
+
+	op, err := m.Service.Disks.Insert(projectID, zone, disk).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WaitOperation(projectID, op); err != nil {
+		return nil, errors.Wrapf(err, "create disk fails: disk[%s]", name)
+	}
+
+	return m.GetDisk(projectID, zone, name)
+}
+
+// ResizeDisk grows the disk and blocks till it's resized, the file system should be resized in the VM
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.Resize
+func (m *Manager) ResizeDisk(projectID, zone, name string, sizeGb int64) error {
+	log.Debugf("ResizeDisk: project[%s], zone[%s], disk[%s], sizeGb[%d]", projectID, zone, name, sizeGb)
+
+	op, err := m.Service.Disks.Resize(projectID, zone, name, &compute.DisksResizeRequest{SizeGb: sizeGb}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// SetDiskLabels replaces the labels of the disk and blocks till they're set
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.SetLabels
+func (m *Manager) SetDiskLabels(projectID, zone, name string, labels map[string]string) error {
+	log.Debugf("SetDiskLabels: project[%s], zone[%s], disk[%s], labels[%v]", projectID, zone, name, labels)
+
+	disk, err := m.GetDisk(projectID, zone, name)
+	if err != nil {
+		return err
+	}
+
+	op, err := m.Service.Disks.SetLabels(projectID, zone, name, &compute.ZoneSetLabelsRequest{
+		Labels:           labels,
+		LabelFingerprint: disk.LabelFingerprint,
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// AttachDisk attaches the disk to the VM and blocks till it's attached
+// https://godoc.org/google.golang.org/api/compute/v1#InstancesService.AttachDisk
+func (m *Manager) AttachDisk(projectID, zone, vmName, diskName string, options *AttachDiskOptions) error {
+	log.Debugf("AttachDisk: project[%s], zone[%s], VM[%s], disk[%s]", projectID, zone, vmName, diskName)
+
+	if options == nil {
+		options = &AttachDiskOptions{}
+	}
+	attached := &compute.AttachedDisk{
+		Source:     fmt.Sprintf("projects/%s/zones/%s/disks/%s", projectID, zone, diskName),
+		DeviceName: options.DeviceName,
+		Mode:       options.Mode,
+		AutoDelete: options.AutoDelete,
+	}
+	if attached.DeviceName == "" {
+		attached.DeviceName = diskName
+	}
+	if attached.Mode == "" {
+		attached.Mode = DiskModeReadWrite
+	}
+
+	op, err := m.Service.Instances.AttachDisk(projectID, zone, vmName, attached).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DetachDisk detaches the disk of the device name from the VM and blocks till it's detached
+// https://godoc.org/google.golang.org/api/compute/v1#InstancesService.DetachDisk
+func (m *Manager) DetachDisk(projectID, zone, vmName, deviceName string) error {
+	log.Debugf("DetachDisk: project[%s], zone[%s], VM[%s], device[%s]", projectID, zone, vmName, deviceName)
+
+	op, err := m.Service.Instances.DetachDisk(projectID, zone, vmName, deviceName).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// SetDiskAutoDelete sets whether the disk of the device name is deleted with the VM
+// https://godoc.org/google.golang.org/api/compute/v1#InstancesService.SetDiskAutoDelete
+func (m *Manager) SetDiskAutoDelete(projectID, zone, vmName, deviceName string, autoDelete bool) error {
+	log.Debugf("SetDiskAutoDelete: project[%s], zone[%s], VM[%s], device[%s], autoDelete[%t]",
+		projectID, zone, vmName, deviceName, autoDelete)
+
+	op, err := m.Service.Instances.SetDiskAutoDelete(projectID, zone, vmName, autoDelete, deviceName).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// GetAttachedDisk gets the disk of the device name attached to the VM, nil if not attached
+func (m *Manager) GetAttachedDisk(projectID, zone, vmName, deviceName string) (*compute.AttachedDisk, error) {
+	vm, err := m.GetVM(projectID, zone, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disk := range vm.Disks {
+		if disk.DeviceName == deviceName {
+			return disk, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// SwapDisk replaces the disk of the device name by the new disk with the same mode and auto-delete,
+// and returns the name of the detached disk. The disk should be unmounted in the VM before.
+// If the new disk fails to attach, the old disk is reattached with its original options, and the error
+// reports both failures if the reattach fails too.
+func (m *Manager) SwapDisk(projectID, zone, vmName, deviceName, newDiskName string) (string, error) {
+	log.Infof("SwapDisk: project[%s], zone[%s], VM[%s], device[%s], disk[%s]",
+		projectID, zone, vmName, deviceName, newDiskName)
+
+	old, err := m.GetAttachedDisk(projectID, zone, vmName, deviceName)
+	if err != nil {
+		return "", err
+	}
+	if old == nil {
+		return "", errors.Errorf("no disk attached: VM[%s], device[%s]", vmName, deviceName)
+	}
+	if old.Boot {
+		return "", errors.Errorf("boot disk cannot be swapped: VM[%s], device[%s]", vmName, deviceName)
+	}
+	oldDiskName := formatutil.GetLastSplit(old.Source, "/")
+
+	if err := m.DetachDisk(projectID, zone, vmName, deviceName); err != nil {
+		return "", errors.Wrapf(err, "detach disk fails: disk[%s]", oldDiskName)
+	}
+
+	options := &AttachDiskOptions{DeviceName: deviceName, Mode: old.Mode, AutoDelete: old.AutoDelete}
+	if err := m.AttachDisk(projectID, zone, vmName, newDiskName, options); err != nil {
+		if reattachErr := m.AttachDisk(projectID, zone, vmName, oldDiskName, options); reattachErr != nil {
+			return oldDiskName, errors.Errorf("attach disk fails: disk[%s], %v, and reattach fails: old disk[%s], %v",
+				newDiskName, err, oldDiskName, reattachErr)
+		}
+		return "", errors.Wrapf(err, "attach disk fails, the old disk[%s] is reattached: disk[%s]",
+			oldDiskName, newDiskName)
+	}
+
+	return oldDiskName, nil
+}
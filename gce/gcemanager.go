@@ -2,12 +2,9 @@
 package gce
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/iKala/gosak/collectionutil"
@@ -338,7 +335,9 @@ func (m *Manager) GetSnapshot(projectID, snapshot string) (*compute.Snapshot, er
 	return result, nil
 }
 
-// GetLatestSnapshot gets latest snapshot with specified prefix in its name
+// GetLatestSnapshot gets latest snapshot with specified prefix in its name.
+// It matches any part of the name and sorts by name, use FindNewestSnapshot to query by
+// creation time instead.
 func (m *Manager) GetLatestSnapshot(prefix string, snapshots []*compute.Snapshot) (*compute.Snapshot, error) {
 	filteredSnapshots := []*compute.Snapshot{}
 	for _, snapshot := range snapshots {
@@ -676,47 +675,109 @@ func (m *Manager) ListInstanceGroupManagers(projectID, zone string) (
 	return instanceGroupManagerService.List(projectID, zone).Do()
 }
 
-// SetInstanceTemplate ...
-// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.SetInstanceTemplate
-func (m *Manager) SetInstanceTemplate(projectID, zone, instanceGroupManager, instanceTemplate string) error {
-	instanceGroupManagerService := compute.NewInstanceGroupManagersService(m.Service)
+// NewInstanceGroupManager creates the managed instance group and blocks till it's created.
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.Insert
+func (m *Manager) NewInstanceGroupManager(projectID, zone string, igm *compute.InstanceGroupManager) error {
+	log.Debugf("NewInstanceGroupManager: project[%s], zone[%s], igm[%s]", projectID, zone, igm.Name)
 
-	templateRequest := &compute.InstanceGroupManagersSetInstanceTemplateRequest{
-		InstanceTemplate: instanceTemplate,
+	op, err := m.Service.InstanceGroupManagers.Insert(projectID, zone, igm).Do()
+	if err != nil {
+		return err
 	}
-	if _, err := instanceGroupManagerService.SetInstanceTemplate(
-		projectID, zone, instanceGroupManager, templateRequest).Do(); err != nil {
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DeleteInstanceGroupManager deletes the managed instance group with its instances and blocks till it's deleted.
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.Delete
+func (m *Manager) DeleteInstanceGroupManager(projectID, zone, instanceGroupManagerName string) error {
+	log.Debugf("DeleteInstanceGroupManager: project[%s], zone[%s], igm[%s]",
+		projectID, zone, instanceGroupManagerName)
+
+	op, err := m.Service.InstanceGroupManagers.Delete(projectID, zone, instanceGroupManagerName).Do()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return m.WaitOperation(projectID, op)
 }
 
-// InitVMFromTemplate builds the sample VM from template
-func (m *Manager) InitVMFromTemplate(templateFile []byte, zone string) (*compute.Instance, error) {
-	type TemplateParameter struct {
-		Zone string
+// PatchInstanceGroupManager patches the non-empty fields of the managed instance group, e.g. target pools
+// and named ports, and blocks till it's patched. The versions are patched by replicapoolupdater.MigManager.
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.Patch
+func (m *Manager) PatchInstanceGroupManager(
+	projectID, zone, instanceGroupManagerName string, igm *compute.InstanceGroupManager) error {
+
+	log.Debugf("PatchInstanceGroupManager: project[%s], zone[%s], igm[%s]", projectID, zone, instanceGroupManagerName)
+
+	op, err := m.Service.InstanceGroupManagers.Patch(projectID, zone, instanceGroupManagerName, igm).Do()
+	if err != nil {
+		return err
 	}
-	var tp = TemplateParameter{Zone: zone}
 
-	tmpl, _ := template.New("test").Parse(string(templateFile[:]))
-	var b bytes.Buffer
-	tmpl.Execute(&b, tp)
+	return m.WaitOperation(projectID, op)
+}
+
+// ListManagedInstances lists the instances of the managed instance group with their current actions.
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.ListManagedInstances
+func (m *Manager) ListManagedInstances(projectID, zone, instanceGroupManagerName string) (
+	[]*compute.ManagedInstance, error) {
 
-	var vm compute.Instance
-	err := json.Unmarshal(b.Bytes(), &vm)
+	log.Tracef("ListManagedInstances: project[%s], zone[%s], igm[%s]", projectID, zone, instanceGroupManagerName)
+
+	res, err := m.Service.InstanceGroupManagers.ListManagedInstances(projectID, zone, instanceGroupManagerName).Do()
 	if err != nil {
 		return nil, err
 	}
 
-	return &vm, nil
+	return res.ManagedInstances, nil
 }
 
-// GetNatIP gets NAT IP address from VM
+// SetInstanceGroupManagerTargetPools replaces the target pools of the managed instance group, which applies
+// to the instances recreated by the group too, and blocks till they're set. Empty pools remove all of them.
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.SetTargetPools
+func (m *Manager) SetInstanceGroupManagerTargetPools(
+	projectID, zone, instanceGroupManagerName string, targetPools []string) error {
+
+	log.Debugf("SetInstanceGroupManagerTargetPools: project[%s], zone[%s], igm[%s], targetPools[%v]",
+		projectID, zone, instanceGroupManagerName, targetPools)
+
+	op, err := m.Service.InstanceGroupManagers.SetTargetPools(projectID, zone, instanceGroupManagerName,
+		&compute.InstanceGroupManagersSetTargetPoolsRequest{
+			TargetPools:     targetPools,
+			ForceSendFields: []string{"TargetPools"},
+		}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// SetInstanceTemplate ...
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.SetInstanceTemplate
+func (m *Manager) SetInstanceTemplate(projectID, zone, instanceGroupManager, instanceTemplate string) error {
+	instanceGroupManagerService := compute.NewInstanceGroupManagersService(m.Service)
+
+	templateRequest := &compute.InstanceGroupManagersSetInstanceTemplateRequest{
+		InstanceTemplate: instanceTemplate,
+	}
+	if _, err := instanceGroupManagerService.SetInstanceTemplate(
+		projectID, zone, instanceGroupManager, templateRequest).Do(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetNatIP gets NAT IP address from VM, empty if the VM has no external IP
 func (m *Manager) GetNatIP(vm *compute.Instance) string {
 	if vm == nil {
 		return "missing"
 	}
+	if len(vm.NetworkInterfaces) == 0 || len(vm.NetworkInterfaces[0].AccessConfigs) == 0 {
+		return ""
+	}
 	natIP := vm.NetworkInterfaces[0].AccessConfigs[0].NatIP
 
 	log.Tracef("Got NatIP: VM[%s], ip[%s]", vm.Name, natIP)
@@ -729,6 +790,9 @@ func (m *Manager) GetNetworkIP(vm *compute.Instance) string {
 	if vm == nil {
 		return "missing"
 	}
+	if len(vm.NetworkInterfaces) == 0 {
+		return ""
+	}
 	networkIP := vm.NetworkInterfaces[0].NetworkIP
 
 	log.Tracef("Got NetworkIP: VM[%s], ip[%s]", vm.Name, networkIP)
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -205,6 +206,232 @@ func (suite *GceManagerTestSuite) Test_GetSnapshot() {
 	assert.Equal(suite.T(), snapshotName, snapshot.Name)
 }
 
+func (suite *GceManagerTestSuite) Test_NewDiskWithOptionsValidation() {
+	_, err := tested.NewDiskWithOptions(projID, zone, "disk-invalid", &DiskOptions{})
+	assert.NotNil(suite.T(), err)
+
+	_, err = tested.NewDiskWithOptions(projID, zone, "disk-invalid", &DiskOptions{
+		SourceImage:    "projects/debian-cloud/global/images/family/debian-8",
+		SourceSnapshot: "global/snapshots/" + snapshotName,
+	})
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *GceManagerTestSuite) Test_DiskManagement() {
+	if testing.Short() {
+		suite.T().Skip("disk operations take minutes")
+	}
+
+	dataDisk, newDataDisk := "disk-test-data", "disk-test-data-new"
+	disk, err := tested.NewDiskWithOptions(projID, zone, dataDisk, &DiskOptions{
+		SizeGb: 10,
+		Type:   DiskTypeSSD,
+		Labels: map[string]string{"env": "test"},
+	})
+	require.Nil(suite.T(), err)
+	defer tested.DeleteDisk(projID, zone, dataDisk)
+	assert.True(suite.T(), strings.HasSuffix(disk.Type, "/"+DiskTypeSSD))
+	assert.Equal(suite.T(), "test", disk.Labels["env"])
+
+	_, err = tested.NewDiskWithOptions(projID, zone, newDataDisk, &DiskOptions{
+		SourceImage: "projects/debian-cloud/global/images/family/debian-8",
+	})
+	require.Nil(suite.T(), err)
+	defer tested.DeleteDisk(projID, zone, newDataDisk)
+
+	err = tested.ResizeDisk(projID, zone, dataDisk, 20)
+	assert.Nil(suite.T(), err)
+	err = tested.SetDiskLabels(projID, zone, dataDisk, map[string]string{"env": "prod"})
+	assert.Nil(suite.T(), err)
+	disk, _ = tested.GetDisk(projID, zone, dataDisk)
+	assert.Equal(suite.T(), int64(20), disk.SizeGb)
+	assert.Equal(suite.T(), map[string]string{"env": "prod"}, disk.Labels)
+
+	// Attach, swap then detach the data disk
+	err = tested.AttachDisk(projID, zone, vmName, dataDisk, &AttachDiskOptions{DeviceName: "data"})
+	require.Nil(suite.T(), err)
+	err = tested.SetDiskAutoDelete(projID, zone, vmName, "data", false)
+	assert.Nil(suite.T(), err)
+
+	old, err := tested.SwapDisk(projID, zone, vmName, "data", newDataDisk)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), dataDisk, old)
+	attached, err := tested.GetAttachedDisk(projID, zone, vmName, "data")
+	assert.Nil(suite.T(), err)
+	require.NotNil(suite.T(), attached)
+	assert.True(suite.T(), strings.HasSuffix(attached.Source, "/"+newDataDisk))
+	assert.Equal(suite.T(), DiskModeReadWrite, attached.Mode)
+
+	err = tested.DetachDisk(projID, zone, vmName, "data")
+	assert.Nil(suite.T(), err)
+	attached, _ = tested.GetAttachedDisk(projID, zone, vmName, "data")
+	assert.Nil(suite.T(), attached)
+}
+
+func (suite *GceManagerTestSuite) Test_CreateThenDeleteSnapshot() {
+	if testing.Short() {
+		suite.T().Skip("creating snapshot takes minutes")
+	}
+
+	name := scheduledSnapshotName(diskName, time.Now())
+	snapshot, err := tested.CreateSnapshot(projID, zone, diskName, name, map[string]string{"env": "test"})
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), name, snapshot.Name)
+	assert.Equal(suite.T(), "test", snapshot.Labels["env"])
+
+	snapshots, err := tested.ListSnapshotsWithFilter(projID, "labels.env eq test")
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), len(snapshots) > 0)
+
+	err = tested.DeleteSnapshot(projID, name)
+	assert.Nil(suite.T(), err)
+}
+
+func (suite *GceManagerTestSuite) Test_RetentionPolicy() {
+	// snapshots of every 12 hours for 20 days, the latest first
+	latest := time.Date(2017, 3, 20, 12, 0, 0, 0, time.UTC)
+	snapshots := []*compute.Snapshot{}
+	for i := 0; i < 40; i++ {
+		t := latest.Add(-time.Duration(i) * 12 * time.Hour)
+		snapshots = append(snapshots, &compute.Snapshot{
+			Name:              scheduledSnapshotName("disk", t),
+			CreationTimestamp: t.Format(time.RFC3339),
+		})
+	}
+	kept := func(policy RetentionPolicy) []string {
+		expired := map[string]bool{}
+		for _, snapshot := range policy.Expired(snapshots) {
+			expired[snapshot.Name] = true
+		}
+		names := []string{}
+		for _, snapshot := range snapshots {
+			if !expired[snapshot.Name] {
+				names = append(names, snapshot.Name)
+			}
+		}
+		return names
+	}
+
+	assert.Equal(suite.T(), 40, len(kept(RetentionPolicy{})))
+	assert.Equal(suite.T(), []string{"disk-20170320120000", "disk-20170320000000", "disk-20170319120000"},
+		kept(RetentionPolicy{KeepLast: 3}))
+	assert.Equal(suite.T(), []string{"disk-20170320120000", "disk-20170319120000"},
+		kept(RetentionPolicy{KeepDaily: 2}))
+	// 2017-03-20 is Monday, 2017-03-19 is Sunday
+	assert.Equal(suite.T(), []string{"disk-20170320120000", "disk-20170319120000", "disk-20170312120000"},
+		kept(RetentionPolicy{KeepWeekly: 3}))
+	assert.Equal(suite.T(), []string{"disk-20170320120000", "disk-20170320000000", "disk-20170319120000",
+		"disk-20170312120000"},
+		kept(RetentionPolicy{KeepLast: 2, KeepDaily: 2, KeepWeekly: 3}))
+
+	// snapshots of unknown time are never expired
+	assert.Equal(suite.T(), 0, len((&RetentionPolicy{KeepLast: 1}).Expired(
+		[]*compute.Snapshot{{Name: "unknown"}})))
+}
+
+func (suite *GceManagerTestSuite) Test_CronSchedule() {
+	at := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		return t
+	}
+	now := at("2017-03-20 10:07") // Monday
+
+	cases := []struct {
+		expr string
+		next string
+	}{
+		{"* * * * *", "2017-03-20 10:08"},
+		{"*/15 * * * *", "2017-03-20 10:15"},
+		{"30 2 * * *", "2017-03-21 02:30"},
+		{"0 0 * * 0", "2017-03-26 00:00"},
+		{"0 0 * * 7", "2017-03-26 00:00"},
+		{"0 9-17/4 * * 1-5", "2017-03-20 13:00"},
+		{"0 0 1 * *", "2017-04-01 00:00"},
+		{"0 0 1,15 * 3", "2017-03-22 00:00"},
+		{"0 0 29 2 *", "2020-02-29 00:00"},
+	}
+	for _, c := range cases {
+		schedule, err := ParseCronSchedule(c.expr)
+		require.Nil(suite.T(), err, c.expr)
+		assert.Equal(suite.T(), at(c.next), schedule.Next(now), c.expr)
+	}
+
+	schedule, _ := ParseCronSchedule("0 0 30 2 *")
+	assert.True(suite.T(), schedule.Next(now).IsZero())
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseCronSchedule(invalid)
+		assert.NotNil(suite.T(), err, invalid)
+	}
+}
+
+func (suite *GceManagerTestSuite) Test_SnapshotQuery() {
+	diskURL := "https://www.googleapis.com/compute/v1/projects/gogoo/zones/asia-east1-b/disks/"
+	snapshots := []*compute.Snapshot{
+		{Name: "web-data-b", SourceDisk: diskURL + "web-data", Status: SnapshotStatusReady,
+			CreationTimestamp: "2017-03-20T12:00:00.000-07:00", Labels: map[string]string{"env": "prod"}},
+		{Name: "web-data-a", SourceDisk: diskURL + "web-data", Status: SnapshotStatusReady,
+			CreationTimestamp: "2017-03-21T12:00:00.000-07:00", Labels: map[string]string{"env": "prod"}},
+		{Name: "web-data-c", SourceDisk: diskURL + "web-data", Status: "CREATING",
+			CreationTimestamp: "2017-03-22T12:00:00.000-07:00"},
+		{Name: "old-web-data", SourceDisk: diskURL + "old-web-data", Status: SnapshotStatusReady,
+			CreationTimestamp: "2017-03-23T12:00:00.000-07:00"},
+	}
+	names := func(query *SnapshotQuery) []string {
+		result := []string{}
+		for _, snapshot := range FilterSnapshots(snapshots, query) {
+			result = append(result, snapshot.Name)
+		}
+		return result
+	}
+
+	// by creation time instead of name
+	assert.Equal(suite.T(), []string{"web-data-b", "web-data-a", "web-data-c"},
+		names(&SnapshotQuery{Prefix: "web-data"}))
+	assert.Equal(suite.T(), []string{"web-data-b", "web-data-a", "web-data-c"},
+		names(&SnapshotQuery{SourceDisk: "web-data"}))
+	assert.Equal(suite.T(), []string{"old-web-data"},
+		names(&SnapshotQuery{SourceDisk: "zones/asia-east1-b/disks/old-web-data"}))
+	assert.Equal(suite.T(), []string{}, names(&SnapshotQuery{SourceDisk: "zones/us-central1-a/disks/web-data"}))
+	assert.Equal(suite.T(), []string{"web-data-b", "web-data-a"},
+		names(&SnapshotQuery{Labels: map[string]string{"env": "prod"}}))
+	assert.Equal(suite.T(), []string{"web-data-a", "web-data-c"}, names(&SnapshotQuery{
+		CreatedSince: time.Date(2017, 3, 21, 19, 0, 0, 0, time.UTC),
+		CreatedUntil: time.Date(2017, 3, 22, 19, 0, 0, 0, time.UTC),
+	}))
+
+	newest, err := NewestSnapshot(snapshots, &SnapshotQuery{SourceDisk: "web-data", ReadyOnly: true})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "web-data-a", newest.Name)
+
+	_, err = NewestSnapshot(snapshots, &SnapshotQuery{Prefix: "data"})
+	assert.Equal(suite.T(), ErrSnapshotNotFound, err)
+}
+
+func (suite *GceManagerTestSuite) Test_RestoreDiskToPointInTime() {
+	if testing.Short() {
+		suite.T().Skip("creating disk takes minutes")
+	}
+
+	source, err := tested.GetSnapshot(projID, snapshotName)
+	require.Nil(suite.T(), err)
+	at, err := time.Parse(time.RFC3339, source.CreationTimestamp)
+	require.Nil(suite.T(), err)
+
+	restoredDisk := "disk-test-restored"
+	snapshot, err := tested.RestoreDiskToPointInTime(projID, zone, restoredDisk, source.SourceDisk, at, 0)
+	require.Nil(suite.T(), err)
+	defer tested.DeleteDisk(projID, zone, restoredDisk)
+
+	assert.Equal(suite.T(), source.SourceDisk, snapshot.SourceDisk)
+	createdAt, _ := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+	assert.False(suite.T(), createdAt.After(at))
+
+	disk, err := tested.GetDisk(projID, zone, restoredDisk)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), snapshot.Name, tested.GetSnapshotOfDisk(disk))
+}
+
 func (suite *GceManagerTestSuite) Test_GetSnapshotOfDisk() {
 	disk, _ := getTestDisk()
 
@@ -337,6 +564,95 @@ func (suite *GceManagerTestSuite) Test_InstanceTemplateOperation() {
 	}
 }
 
+func (suite *GceManagerTestSuite) Test_DeriveInstanceTemplate() {
+	startup := "echo v1"
+	base := &compute.InstanceTemplate{
+		Name:     "base",
+		Id:       1,
+		SelfLink: "link",
+		Properties: &compute.InstanceProperties{
+			MachineType: "n1-standard-1",
+			Disks: []*compute.AttachedDisk{
+				{Boot: true, InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: "image-v1"}},
+			},
+			Metadata: &compute.Metadata{
+				Fingerprint: "fp",
+				Items:       []*compute.MetadataItems{{Key: "startup-script", Value: &startup}},
+			},
+			Labels: map[string]string{"app": "web"},
+		},
+	}
+
+	template, err := deriveInstanceTemplate(base, "web-v2", &TemplateOverrides{
+		Image:       "image-v2",
+		MachineType: "n1-standard-2",
+		Metadata:    map[string]string{"startup-script": "echo v2", "version": "2"},
+		Tags:        []string{"http-server"},
+		Labels:      map[string]string{"version": "2"},
+	})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "web-v2", template.Name)
+	assert.Equal(suite.T(), uint64(0), template.Id)
+	assert.Equal(suite.T(), "image-v2", template.Properties.Disks[0].InitializeParams.SourceImage)
+	assert.Equal(suite.T(), "n1-standard-2", template.Properties.MachineType)
+	assert.Equal(suite.T(), "", template.Properties.Metadata.Fingerprint)
+	assert.Equal(suite.T(), 2, len(template.Properties.Metadata.Items))
+	assert.Equal(suite.T(), "echo v2", *template.Properties.Metadata.Items[0].Value)
+	assert.Equal(suite.T(), "version", template.Properties.Metadata.Items[1].Key)
+	assert.Equal(suite.T(), []string{"http-server"}, template.Properties.Tags.Items)
+	assert.Equal(suite.T(), map[string]string{"app": "web", "version": "2"}, template.Properties.Labels)
+
+	// the base template is untouched
+	assert.Equal(suite.T(), "image-v1", base.Properties.Disks[0].InitializeParams.SourceImage)
+	assert.Equal(suite.T(), "echo v1", *base.Properties.Metadata.Items[0].Value)
+	assert.Equal(suite.T(), map[string]string{"app": "web"}, base.Properties.Labels)
+}
+
+func (suite *GceManagerTestSuite) Test_ParseTemplateVersion() {
+	assert.Equal(suite.T(), "web-v12", TemplateVersionName("web", 12))
+
+	version, ok := ParseTemplateVersion("web", "web-v12")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 12, version)
+
+	_, ok = ParseTemplateVersion("web", "web-api-v1")
+	assert.False(suite.T(), ok)
+	_, ok = ParseTemplateVersion("web", "web-vx")
+	assert.False(suite.T(), ok)
+}
+
+func (suite *GceManagerTestSuite) Test_GarbageCollectNegativeKeep() {
+	deleted, err := tested.GarbageCollectInstanceTemplateVersions(projID, "gogoo-tpl-test", -1)
+	assert.NotNil(suite.T(), err)
+	assert.Nil(suite.T(), deleted)
+}
+
+func (suite *GceManagerTestSuite) Test_InstanceTemplateVersions() {
+	if testing.Short() {
+		suite.T().Skip("creating templates takes minutes")
+	}
+
+	family := "gogoo-tpl-test"
+	for i := 0; i < 3; i++ {
+		_, err := tested.NewInstanceTemplateVersion(projID, family, instanceTemplateName,
+			&TemplateOverrides{Metadata: map[string]string{"version": fmt.Sprint(i)}})
+		require.Nil(suite.T(), err)
+	}
+
+	versions, err := tested.ListInstanceTemplateVersions(projID, family)
+	assert.Nil(suite.T(), err)
+	require.Equal(suite.T(), 3, len(versions))
+	assert.Equal(suite.T(), TemplateVersionName(family, 3), versions[2].Name)
+
+	deleted, err := tested.GarbageCollectInstanceTemplateVersions(projID, family, 1)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{TemplateVersionName(family, 1), TemplateVersionName(family, 2)}, deleted)
+
+	deleted, err = tested.GarbageCollectInstanceTemplateVersions(projID, family, 0)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{TemplateVersionName(family, 3)}, deleted)
+}
+
 func (suite *GceManagerTestSuite) Test_InstanceGroupManagerOperation() {
 	{
 		gm, err := tested.GetInstanceGroupManager(projID, zone, instanceGroupManagerName)
@@ -384,6 +700,132 @@ func (suite *GceManagerTestSuite) Test_InstanceGroupManagerOperation() {
 	assert.Nil(suite.T(), err)
 }
 
+func (suite *GceManagerTestSuite) Test_InitVMFromTemplateWithParams() {
+	dir, err := ioutil.TempDir("", "gogoo-vm")
+	require.Nil(suite.T(), err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "startup.sh"), []byte("#!/bin/sh\necho \"hello\"\n"), 0644)
+	require.Nil(suite.T(), err)
+
+	params := &VMTemplateParams{
+		ProjectID:   "gogoo",
+		Zone:        zone,
+		Name:        "vm-test",
+		MachineType: "n1-standard-1",
+		Image:       "projects/debian-cloud/global/images/family/debian-8",
+		Network:     "default",
+		Metadata:    map[string]string{"env": "test"},
+		Vars:        map[string]interface{}{"size": "10"},
+		BaseDir:     dir,
+	}
+	expect := func(vm *compute.Instance) {
+		assert.Equal(suite.T(), "vm-test", vm.Name)
+		assert.Equal(suite.T(), "zones/asia-east1-b/machineTypes/n1-standard-1", vm.MachineType)
+		assert.Equal(suite.T(), int64(10), vm.Disks[0].InitializeParams.DiskSizeGb)
+		assert.Equal(suite.T(), "global/networks/default", vm.NetworkInterfaces[0].Network)
+		assert.Equal(suite.T(), "#!/bin/sh\necho \"hello\"\n", *vm.Metadata.Items[0].Value)
+		assert.Equal(suite.T(), "test", *vm.Metadata.Items[1].Value)
+	}
+
+	jsonTemplate := `{
+		"name": "{{.Name}}",
+		"machineType": "zones/{{.Zone}}/machineTypes/{{.MachineType}}",
+		"disks": [{"boot": true, "initializeParams": {"sourceImage": "{{.Image}}", "diskSizeGb": "{{.Vars.size}}"}}],
+		"networkInterfaces": [{"network": "global/networks/{{.Network}}"}],
+		"metadata": {"items": [
+			{"key": "startup-script", "value": {{file "startup.sh" | json}}},
+			{"key": "env", "value": "{{.Metadata.env}}"}
+		]}
+	}`
+	vm, err := tested.InitVMFromTemplateWithParams([]byte(jsonTemplate), params)
+	require.Nil(suite.T(), err)
+	expect(vm)
+
+	yamlTemplate := `
+name: {{.Name}}
+machineType: zones/{{.Zone}}/machineTypes/{{.MachineType}}
+disks:
+- boot: true
+  initializeParams:
+    sourceImage: {{.Image}}
+    diskSizeGb: "{{.Vars.size}}"
+networkInterfaces:
+- network: global/networks/{{.Network}}
+metadata:
+  items:
+  - key: startup-script
+    value: |
+{{file "startup.sh" | indent 6}}
+  - key: env
+    value: {{.Metadata.env}}
+`
+	err = ioutil.WriteFile(filepath.Join(dir, "vm.yaml"), []byte(yamlTemplate), 0644)
+	require.Nil(suite.T(), err)
+	params.BaseDir = ""
+	vm, err = tested.InitVMFromTemplateFile(filepath.Join(dir, "vm.yaml"), params)
+	require.Nil(suite.T(), err)
+	expect(vm)
+
+	// Template errors
+	_, err = tested.InitVMFromTemplateWithParams([]byte(`{"name": "{{.Name"}`), params)
+	assert.NotNil(suite.T(), err)
+	_, err = tested.InitVMFromTemplateWithParams([]byte(`{"name": "{{.Vars.missing}}"}`), params)
+	assert.NotNil(suite.T(), err)
+	_, err = tested.InitVMFromTemplateWithParams([]byte(`{"name": "{{file "missing.sh"}}"}`), params)
+	assert.NotNil(suite.T(), err)
+
+	// Validation errors
+	_, err = tested.InitVMFromTemplateWithParams(
+		[]byte(strings.Replace(jsonTemplate, "zones/{{.Zone}}", "zones/us-central1-a", 1)),
+		&VMTemplateParams{Zone: zone, Name: "vm-test", MachineType: "n1-standard-1", Image: params.Image,
+			Network: "default", Metadata: params.Metadata, Vars: params.Vars, BaseDir: dir})
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *GceManagerTestSuite) Test_ValidateVM() {
+	valid := func() *compute.Instance {
+		return &compute.Instance{
+			Name:        "vm-test",
+			MachineType: "projects/gogoo/zones/asia-east1-b/machineTypes/n1-standard-1",
+			Disks: []*compute.AttachedDisk{
+				{Boot: true, InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: "https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/debian-8",
+					DiskType:    "zones/asia-east1-b/diskTypes/pd-ssd",
+				}},
+				{Source: "zones/asia-east1-b/disks/data"},
+			},
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{Subnetwork: "regions/asia-east1/subnetworks/default"},
+			},
+		}
+	}
+	assert.Nil(suite.T(), ValidateVM(valid()))
+
+	blank := valid()
+	blank.Disks = append(blank.Disks, &compute.AttachedDisk{
+		InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 10},
+	})
+	assert.Nil(suite.T(), ValidateVM(blank))
+
+	invalids := []func(vm *compute.Instance){
+		func(vm *compute.Instance) { vm.Name = "VM_test" },
+		func(vm *compute.Instance) { vm.MachineType = "n1-standard-1" },
+		func(vm *compute.Instance) { vm.Disks = nil },
+		func(vm *compute.Instance) { vm.Disks[1].Boot = true },
+		func(vm *compute.Instance) { vm.Disks[0].InitializeParams.SourceImage = "debian-8" },
+		func(vm *compute.Instance) { vm.Disks[0].InitializeParams.SourceImage = "" },
+		func(vm *compute.Instance) { vm.Disks[0].InitializeParams.DiskType = "pd-ssd" },
+		func(vm *compute.Instance) { vm.Disks[1].Source = "data" },
+		func(vm *compute.Instance) { vm.NetworkInterfaces = nil },
+		func(vm *compute.Instance) { vm.NetworkInterfaces[0].Network = "default" },
+	}
+	for i, invalidate := range invalids {
+		vm := valid()
+		invalidate(vm)
+		assert.NotNil(suite.T(), ValidateVM(vm), "invalid[%d]", i)
+	}
+}
+
 func (suite *GceManagerTestSuite) TearDownSuite() {
 	log.Println("======== TearDown  ========")
 
@@ -0,0 +1,81 @@
+package gce
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// OperationTimeout is timeout of waiting an operation to be done
+	OperationTimeout = 10 * time.Minute
+	// OperationPollingInterval is the interval of polling the status of an operation
+	OperationPollingInterval = 3 * time.Second
+
+	// OperationStatusDone ...
+	OperationStatusDone = "DONE"
+)
+
+// ErrOperationTimeout is returned when the operation isn't done within OperationTimeout
+var ErrOperationTimeout = errors.New("operation timeout")
+
+// OperationError is returned when the operation is done with errors
+type OperationError struct {
+	Operation *compute.Operation
+	Errors    []*compute.OperationErrorErrors
+}
+
+func (e *OperationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, oe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", oe.Code, oe.Message))
+	}
+
+	return fmt.Sprintf("operation fails: name[%s], type[%s], target[%s], errors[%s]",
+		e.Operation.Name, e.Operation.OperationType, e.Operation.TargetLink, strings.Join(msgs, "; "))
+}
+
+// WaitOperation blocks till the zonal, regional or global operation to be done,
+// or will be timeout if it takes over `OperationTimeout`.
+// *OperationError is returned if the operation is done with errors.
+// https://godoc.org/google.golang.org/api/compute/v1#ZoneOperationsService.Get
+func (m *Manager) WaitOperation(projectID string, op *compute.Operation) error {
+	log.Tracef("WaitOperation: project[%s], operation[%s], type[%s]", projectID, op.Name, op.OperationType)
+
+	startTime := time.Now()
+	for op.Status != OperationStatusDone {
+		if time.Now().Sub(startTime) > OperationTimeout {
+			log.Warnf("Operation timeout: operation[%s], type[%s]", op.Name, op.OperationType)
+			return ErrOperationTimeout
+		}
+
+		time.Sleep(OperationPollingInterval)
+
+		var polled *compute.Operation
+		var err error
+		switch {
+		case op.Zone != "":
+			polled, err = m.Service.ZoneOperations.Get(projectID, formatutil.GetLastSplit(op.Zone, "/"), op.Name).Do()
+		case op.Region != "":
+			polled, err = m.Service.RegionOperations.Get(projectID, formatutil.GetLastSplit(op.Region, "/"), op.Name).Do()
+		default:
+			polled, err = m.Service.GlobalOperations.Get(projectID, op.Name).Do()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get operation fails: operation[%s]", op.Name)
+		}
+		op = polled
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &OperationError{Operation: op, Errors: op.Error.Errors}
+	}
+
+	return nil
+}
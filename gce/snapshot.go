@@ -0,0 +1,584 @@
+package gce
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// SnapshotScheduleLabel labels the snapshots taken by the snapshot schedule with its name.
+	// Retention policies only delete the snapshots of the schedule.
+	SnapshotScheduleLabel = "gogoo-snapshot-schedule"
+	// SnapshotTimeFormat is the time suffix of snapshot names taken by schedules
+	SnapshotTimeFormat = "20060102150405"
+	// SnapshotStatusReady ...
+	SnapshotStatusReady = "READY"
+)
+
+// ErrSnapshotNotFound is returned when no snapshot matches the query
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// CreateSnapshot creates the snapshot of the disk with the labels and blocks till it's ready
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.CreateSnapshot
+func (m *Manager) CreateSnapshot(
+	projectID, zone, disk, name string, labels map[string]string) (*compute.Snapshot, error) {
+
+	log.Debugf("CreateSnapshot: project[%s], zone[%s], disk[%s], snapshot[%s]", projectID, zone, disk, name)
+
+	op, err := m.Service.Disks.CreateSnapshot(projectID, zone, disk, &compute.Snapshot{
+		Name:   name,
+		Labels: labels,
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WaitOperation(projectID, op); err != nil {
+		return nil, errors.Wrapf(err, "create snapshot fails: disk[%s], snapshot[%s]", disk, name)
+	}
+
+	snapshot, err := m.GetSnapshot(projectID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// labels on creation are ignored by some API versions
+	if len(labels) > 0 && len(snapshot.Labels) == 0 {
+		if err := m.SetSnapshotLabels(projectID, snapshot, labels); err != nil {
+			return nil, err
+		}
+		snapshot.Labels = labels
+	}
+
+	return snapshot, nil
+}
+
+// SetSnapshotLabels replaces the labels of the snapshot and blocks till they're set
+// https://godoc.org/google.golang.org/api/compute/v1#SnapshotsService.SetLabels
+func (m *Manager) SetSnapshotLabels(projectID string, snapshot *compute.Snapshot, labels map[string]string) error {
+	log.Tracef("SetSnapshotLabels: project[%s], snapshot[%s]", projectID, snapshot.Name)
+
+	op, err := m.Service.Snapshots.SetLabels(projectID, snapshot.Name, &compute.GlobalSetLabelsRequest{
+		Labels:           labels,
+		LabelFingerprint: snapshot.LabelFingerprint,
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// DeleteSnapshot deletes the snapshot and blocks till it's deleted
+// https://godoc.org/google.golang.org/api/compute/v1#SnapshotsService.Delete
+func (m *Manager) DeleteSnapshot(projectID, snapshot string) error {
+	log.Debugf("DeleteSnapshot: project[%s], snapshot[%s]", projectID, snapshot)
+
+	op, err := m.Service.Snapshots.Delete(projectID, snapshot).Do()
+	if err != nil {
+		return err
+	}
+
+	return m.WaitOperation(projectID, op)
+}
+
+// ListSnapshotsWithFilter lists all pages of snapshots satisfying the filter, e.g. `labels.env eq prod`
+// https://godoc.org/google.golang.org/api/compute/v1#SnapshotsService.List
+func (m *Manager) ListSnapshotsWithFilter(projectID, filter string) ([]*compute.Snapshot, error) {
+	log.Tracef("ListSnapshotsWithFilter: project[%s], filter[%s]", projectID, filter)
+
+	result := []*compute.Snapshot{}
+	pageToken := ""
+	for {
+		call := m.Service.Snapshots.List(projectID)
+		if filter != "" {
+			call = call.Filter(filter)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res.Items...)
+
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	return result, nil
+}
+
+// SnapshotQuery selects snapshots, the empty fields match all snapshots
+type SnapshotQuery struct {
+	// Prefix matches the beginning of snapshot names
+	Prefix string
+	// SourceDisk matches the name of the source disk, or the tail of its URL if it contains `/`,
+	// e.g. `zones/asia-east1-b/disks/data`
+	SourceDisk string
+	// Labels should all be on the snapshot
+	Labels map[string]string
+	// CreatedSince and CreatedUntil bound the creation time inclusively, zero means unbounded
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	// ReadyOnly skips the snapshots being created or deleted
+	ReadyOnly bool
+}
+
+// Matches tells if the snapshot satisfies the query
+func (q *SnapshotQuery) Matches(snapshot *compute.Snapshot) bool {
+	if !strings.HasPrefix(snapshot.Name, q.Prefix) {
+		return false
+	}
+
+	if q.SourceDisk != "" {
+		if strings.Contains(q.SourceDisk, "/") {
+			disk := strings.TrimPrefix(q.SourceDisk, "/")
+			if snapshot.SourceDisk != disk && !strings.HasSuffix(snapshot.SourceDisk, "/"+disk) {
+				return false
+			}
+		} else if formatutil.GetLastSplit(snapshot.SourceDisk, "/") != q.SourceDisk {
+			return false
+		}
+	}
+
+	for key, value := range q.Labels {
+		if v, ok := snapshot.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	if q.ReadyOnly && snapshot.Status != SnapshotStatusReady {
+		return false
+	}
+
+	if !q.CreatedSince.IsZero() || !q.CreatedUntil.IsZero() {
+		createdAt, err := snapshotCreatedAt(snapshot)
+		if err != nil {
+			return false
+		}
+		if !q.CreatedSince.IsZero() && createdAt.Before(q.CreatedSince) {
+			return false
+		}
+		if !q.CreatedUntil.IsZero() && createdAt.After(q.CreatedUntil) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilterSnapshots returns the snapshots matching the query, the oldest first by creation time.
+// Snapshots of unknown creation time are skipped.
+func FilterSnapshots(snapshots []*compute.Snapshot, query *SnapshotQuery) []*compute.Snapshot {
+	matched := []*compute.Snapshot{}
+	createdAt := map[*compute.Snapshot]time.Time{}
+	for _, snapshot := range snapshots {
+		t, err := snapshotCreatedAt(snapshot)
+		if err != nil || !query.Matches(snapshot) {
+			continue
+		}
+		createdAt[snapshot] = t
+		matched = append(matched, snapshot)
+	}
+	sort.Stable(bySnapshotCreation{matched, createdAt})
+
+	return matched
+}
+
+// NewestSnapshot returns the newest snapshot matching the query by creation time
+func NewestSnapshot(snapshots []*compute.Snapshot, query *SnapshotQuery) (*compute.Snapshot, error) {
+	matched := FilterSnapshots(snapshots, query)
+	if len(matched) == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+
+	return matched[len(matched)-1], nil
+}
+
+// FindSnapshots lists the snapshots of the project matching the query, the oldest first
+func (m *Manager) FindSnapshots(projectID string, query *SnapshotQuery) ([]*compute.Snapshot, error) {
+	log.Tracef("FindSnapshots: project[%s], query[%+v]", projectID, query)
+
+	snapshots, err := m.ListSnapshotsWithFilter(projectID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return FilterSnapshots(snapshots, query), nil
+}
+
+// FindNewestSnapshot finds the newest snapshot of the project matching the query
+func (m *Manager) FindNewestSnapshot(projectID string, query *SnapshotQuery) (*compute.Snapshot, error) {
+	snapshots, err := m.ListSnapshotsWithFilter(projectID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := NewestSnapshot(snapshots, query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query[%+v]", query)
+	}
+	log.Tracef("Newest snapshot found: name[%s], created[%s]", snapshot.Name, snapshot.CreationTimestamp)
+
+	return snapshot, nil
+}
+
+// RestoreDiskToPointInTime creates the disk from the newest ready snapshot of the source disk taken
+// at or before the time, and returns the snapshot. The size of the snapshot is used if sizeGb is zero.
+func (m *Manager) RestoreDiskToPointInTime(
+	projectID, zone, diskName, sourceDisk string, at time.Time, sizeGb int64) (*compute.Snapshot, error) {
+
+	log.Debugf("RestoreDiskToPointInTime: project[%s], zone[%s], disk[%s], source[%s], at[%s]",
+		projectID, zone, diskName, sourceDisk, at)
+
+	snapshot, err := m.FindNewestSnapshot(projectID, &SnapshotQuery{
+		SourceDisk:   sourceDisk,
+		CreatedUntil: at,
+		ReadyOnly:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sizeGb == 0 {
+		sizeGb = snapshot.DiskSizeGb
+	}
+	if err := m.NewDisk(projectID, zone, diskName, "global/snapshots/"+snapshot.Name, sizeGb); err != nil {
+		return nil, errors.Wrapf(err, "restore disk fails: disk[%s], snapshot[%s]", diskName, snapshot.Name)
+	}
+
+	return snapshot, nil
+}
+
+func snapshotCreatedAt(snapshot *compute.Snapshot) (time.Time, error) {
+	return time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+}
+
+// RetentionPolicy decides which snapshots of a disk are kept, the others are deleted.
+// A snapshot is kept if any rule keeps it, and nothing is deleted if all the rules are zero.
+type RetentionPolicy struct {
+	// KeepLast keeps the latest N snapshots
+	KeepLast int
+	// KeepDaily keeps the latest snapshot of each of the latest N days having snapshots
+	KeepDaily int
+	// KeepWeekly keeps the latest snapshot of each of the latest N ISO weeks having snapshots
+	KeepWeekly int
+	// Location is the time zone of days and weeks, UTC if nil
+	Location *time.Location
+}
+
+// Expired returns the snapshots not kept by the policy, the snapshots should be of the same disk
+func (p *RetentionPolicy) Expired(snapshots []*compute.Snapshot) []*compute.Snapshot {
+	expired := []*compute.Snapshot{}
+	if p.KeepLast <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 {
+		return expired
+	}
+
+	location := p.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	// the latest first, snapshots of unknown time are always kept
+	sorted := []*compute.Snapshot{}
+	createdAt := map[*compute.Snapshot]time.Time{}
+	for _, snapshot := range snapshots {
+		t, err := snapshotCreatedAt(snapshot)
+		if err != nil {
+			log.Warnf("Keep snapshot of unknown creation time: snapshot[%s], time[%s]",
+				snapshot.Name, snapshot.CreationTimestamp)
+			continue
+		}
+		createdAt[snapshot] = t.In(location)
+		sorted = append(sorted, snapshot)
+	}
+	sort.Sort(sort.Reverse(bySnapshotCreation{sorted, createdAt}))
+
+	kept := map[*compute.Snapshot]bool{}
+	for i := 0; i < p.KeepLast && i < len(sorted); i++ {
+		kept[sorted[i]] = true
+	}
+
+	// keepPeriods keeps the first, i.e. latest, snapshot of each of the latest n periods
+	keepPeriods := func(n int, period func(t time.Time) string) {
+		seen := map[string]bool{}
+		for _, snapshot := range sorted {
+			key := period(createdAt[snapshot])
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= n {
+				return
+			}
+			seen[key] = true
+			kept[snapshot] = true
+		}
+	}
+	keepPeriods(p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keepPeriods(p.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+
+	for _, snapshot := range sorted {
+		if !kept[snapshot] {
+			expired = append(expired, snapshot)
+		}
+	}
+
+	return expired
+}
+
+type bySnapshotCreation struct {
+	snapshots []*compute.Snapshot
+	createdAt map[*compute.Snapshot]time.Time
+}
+
+func (a bySnapshotCreation) Len() int { return len(a.snapshots) }
+func (a bySnapshotCreation) Swap(i, j int) {
+	a.snapshots[i], a.snapshots[j] = a.snapshots[j], a.snapshots[i]
+}
+func (a bySnapshotCreation) Less(i, j int) bool {
+	return a.createdAt[a.snapshots[i]].Before(a.createdAt[a.snapshots[j]])
+}
+
+// SnapshotSchedule snapshots the selected disks on the cron schedule and applies the retention policy
+type SnapshotSchedule struct {
+	// Name labels the snapshots of the schedule, see SnapshotScheduleLabel
+	Name      string
+	ProjectID string
+	Zone      string
+	// Cron is the 5-field cron expression, see CronSchedule
+	Cron string
+	// Disks are the names of disks to snapshot
+	Disks []string
+	// DiskFilter selects more disks by the filter of disks, e.g. `labels.backup eq true`
+	DiskFilter string
+	// Labels are the extra labels of snapshots
+	Labels    map[string]string
+	Retention RetentionPolicy
+}
+
+func (schedule *SnapshotSchedule) validate() error {
+	if !resourceNamePattern.MatchString(schedule.Name) {
+		return errors.Errorf("bad snapshot schedule name[%s]", schedule.Name)
+	}
+	if schedule.ProjectID == "" || schedule.Zone == "" {
+		return errors.Errorf("incomplete snapshot schedule: %+v", schedule)
+	}
+	if len(schedule.Disks) == 0 && schedule.DiskFilter == "" {
+		return errors.Errorf("snapshot schedule selects no disk: schedule[%s]", schedule.Name)
+	}
+
+	return nil
+}
+
+// RunSnapshotSchedule snapshots the disks of the schedule once and applies its retention policy
+// to each disk. It goes on with the other disks if one fails, and returns the names of created snapshots.
+func (m *Manager) RunSnapshotSchedule(schedule *SnapshotSchedule) ([]string, error) {
+	log.Infof("RunSnapshotSchedule: schedule[%s]", schedule.Name)
+
+	if err := schedule.validate(); err != nil {
+		return nil, err
+	}
+
+	disks, err := m.scheduledDisks(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for key, value := range schedule.Labels {
+		labels[key] = value
+	}
+	labels[SnapshotScheduleLabel] = schedule.Name
+
+	created := []string{}
+	var lastErr error
+	now := time.Now()
+	for _, disk := range disks {
+		snapshot, err := m.CreateSnapshot(schedule.ProjectID, schedule.Zone, disk, scheduledSnapshotName(disk, now), labels)
+		if err != nil {
+			log.Warnf("Scheduled snapshot fails: schedule[%s], disk[%s], err[%s]", schedule.Name, disk, err)
+			lastErr = err
+			continue
+		}
+		created = append(created, snapshot.Name)
+
+		if _, err := m.ApplySnapshotRetention(schedule, disk); err != nil {
+			log.Warnf("Snapshot retention fails: schedule[%s], disk[%s], err[%s]", schedule.Name, disk, err)
+			lastErr = err
+		}
+	}
+
+	return created, lastErr
+}
+
+// ApplySnapshotRetention deletes the snapshots of the disk taken by the schedule but expired by its
+// retention policy, and returns the deleted snapshot names
+func (m *Manager) ApplySnapshotRetention(schedule *SnapshotSchedule, disk string) ([]string, error) {
+	snapshots, err := m.ListSnapshotsWithFilter(schedule.ProjectID,
+		fmt.Sprintf("labels.%s eq %s", SnapshotScheduleLabel, schedule.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	ofDisk := []*compute.Snapshot{}
+	for _, snapshot := range snapshots {
+		if formatutil.GetLastSplit(snapshot.SourceDisk, "/") == disk {
+			ofDisk = append(ofDisk, snapshot)
+		}
+	}
+
+	deleted := []string{}
+	for _, snapshot := range schedule.Retention.Expired(ofDisk) {
+		if err := m.DeleteSnapshot(schedule.ProjectID, snapshot.Name); err != nil {
+			return deleted, errors.Wrapf(err, "delete expired snapshot fails: snapshot[%s]", snapshot.Name)
+		}
+		deleted = append(deleted, snapshot.Name)
+	}
+
+	return deleted, nil
+}
+
+// scheduledDisks returns the unique names of the listed and filtered disks
+func (m *Manager) scheduledDisks(schedule *SnapshotSchedule) ([]string, error) {
+	disks := []string{}
+	seen := map[string]bool{}
+	add := func(disk string) {
+		if !seen[disk] {
+			seen[disk] = true
+			disks = append(disks, disk)
+		}
+	}
+
+	for _, disk := range schedule.Disks {
+		add(disk)
+	}
+
+	if schedule.DiskFilter != "" {
+		pageToken := ""
+		for {
+			call := m.Service.Disks.List(schedule.ProjectID, schedule.Zone).Filter(schedule.DiskFilter)
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			res, err := call.Do()
+			if err != nil {
+				return nil, errors.Wrapf(err, "list disks fails: filter[%s]", schedule.DiskFilter)
+			}
+			for _, disk := range res.Items {
+				add(disk.Name)
+			}
+
+			if res.NextPageToken == "" {
+				break
+			}
+			pageToken = res.NextPageToken
+		}
+	}
+
+	return disks, nil
+}
+
+// scheduledSnapshotName names the snapshot `<disk>-<time>` within 63 characters
+func scheduledSnapshotName(disk string, t time.Time) string {
+	suffix := "-" + t.UTC().Format(SnapshotTimeFormat)
+	if max := 63 - len(suffix); len(disk) > max {
+		disk = disk[:max]
+	}
+
+	return disk + suffix
+}
+
+// SnapshotScheduler runs snapshot schedules till it's stopped
+type SnapshotScheduler struct {
+	m       *Manager
+	entries []*snapshotScheduleEntry
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+type snapshotScheduleEntry struct {
+	schedule *SnapshotSchedule
+	cron     *CronSchedule
+}
+
+// NewSnapshotScheduler creates a scheduler running schedules with the manager
+func (m *Manager) NewSnapshotScheduler() *SnapshotScheduler {
+	return &SnapshotScheduler{m: m, stop: make(chan struct{})}
+}
+
+// Add adds the schedule before the scheduler starts
+func (s *SnapshotScheduler) Add(schedule *SnapshotSchedule) error {
+	if s.started {
+		return errors.New("snapshot scheduler has started")
+	}
+	if err := schedule.validate(); err != nil {
+		return err
+	}
+	cron, err := ParseCronSchedule(schedule.Cron)
+	if err != nil {
+		return errors.Wrapf(err, "schedule[%s]", schedule.Name)
+	}
+
+	s.entries = append(s.entries, &snapshotScheduleEntry{schedule: schedule, cron: cron})
+	return nil
+}
+
+// Start runs every schedule in its own goroutine, runs of the same schedule never overlap
+func (s *SnapshotScheduler) Start() {
+	if s.started {
+		return
+	}
+	s.started = true
+
+	for _, entry := range s.entries {
+		s.wg.Add(1)
+		go s.run(entry)
+	}
+}
+
+// Stop stops the scheduler and blocks till the running snapshots finish
+func (s *SnapshotScheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *SnapshotScheduler) run(entry *snapshotScheduleEntry) {
+	defer s.wg.Done()
+
+	for {
+		next := entry.cron.Next(time.Now())
+		if next.IsZero() {
+			log.Warnf("Snapshot schedule never runs: schedule[%s], cron[%s]", entry.schedule.Name, entry.schedule.Cron)
+			return
+		}
+		log.Debugf("Next snapshot: schedule[%s], at[%s]", entry.schedule.Name, next)
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := s.m.RunSnapshotSchedule(entry.schedule); err != nil {
+			log.Warnf("Snapshot schedule fails: schedule[%s], err[%s]", entry.schedule.Name, err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// TemplateVersionSeparator separates the family and the version of template names, e.g. `web-v3`
+const TemplateVersionSeparator = "-v"
+
+// TemplateOverrides overrides the properties of the base template, empty fields are kept
+type TemplateOverrides struct {
+	// Image is the source image of the boot disk
+	Image       string
+	MachineType string
+	// Metadata is merged into the metadata of the base template
+	Metadata map[string]string
+	// Tags replaces the network tags if not nil
+	Tags []string
+	// Labels is merged into the labels of the base template
+	Labels map[string]string
+	// Description replaces the description of the template
+	Description string
+}
+
+// TemplateVersionName names the version of the template family, e.g. `web-v3`
+func TemplateVersionName(family string, version int) string {
+	return fmt.Sprintf("%s%s%d", family, TemplateVersionSeparator, version)
+}
+
+// ParseTemplateVersion parses the version of the template name in the family
+func ParseTemplateVersion(family, name string) (int, bool) {
+	prefix := family + TemplateVersionSeparator
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(name[len(prefix):])
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+
+	return version, true
+}
+
+// DeriveInstanceTemplate creates the template named name from the base template with the overrides.
+// This method blocks till the template is created.
+func (m *Manager) DeriveInstanceTemplate(
+	projectID, baseName, name string, overrides *TemplateOverrides) (*compute.InstanceTemplate, error) {
+
+	log.Debugf("DeriveInstanceTemplate: project[%s], base[%s], name[%s]", projectID, baseName, name)
+
+	base, err := m.GetInstanceTemplate(projectID, baseName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get base template fails: template[%s]", baseName)
+	}
+
+	template, err := deriveInstanceTemplate(base, name, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.NewInstanceTemplate(projectID, template); err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// NewInstanceTemplateVersion creates the next version of the template family derived from baseName,
+// or from the latest version if baseName is empty.
+func (m *Manager) NewInstanceTemplateVersion(
+	projectID, family, baseName string, overrides *TemplateOverrides) (*compute.InstanceTemplate, error) {
+
+	versions, err := m.ListInstanceTemplateVersions(projectID, family)
+	if err != nil {
+		return nil, err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		version, _ := ParseTemplateVersion(family, latest.Name)
+		next = version + 1
+		if baseName == "" {
+			baseName = latest.Name
+		}
+	}
+	if baseName == "" {
+		return nil, errors.Errorf("no base template for the first version: family[%s]", family)
+	}
+
+	return m.DeriveInstanceTemplate(projectID, baseName, TemplateVersionName(family, next), overrides)
+}
+
+// ListInstanceTemplateVersions lists the versions of the template family, the oldest first
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceTemplatesService.List
+func (m *Manager) ListInstanceTemplateVersions(projectID, family string) ([]*compute.InstanceTemplate, error) {
+	log.Tracef("ListInstanceTemplateVersions: project[%s], family[%s]", projectID, family)
+
+	result := []*compute.InstanceTemplate{}
+	pageToken := ""
+	for {
+		call := m.Service.InstanceTemplates.List(projectID)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, template := range res.Items {
+			if _, ok := ParseTemplateVersion(family, template.Name); ok {
+				result = append(result, template)
+			}
+		}
+
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	sort.Sort(byTemplateVersion{family, result})
+	return result, nil
+}
+
+// GarbageCollectInstanceTemplateVersions deletes the versions of the template family except the latest keep ones
+// and the ones referenced by any instance group manager, and returns the deleted template names.
+// The templates of the versions of rolling updates are only known by compute beta, they're skipped
+// when the deletion is rejected as in use.
+func (m *Manager) GarbageCollectInstanceTemplateVersions(projectID, family string, keep int) ([]string, error) {
+	log.Debugf("GarbageCollectInstanceTemplateVersions: project[%s], family[%s], keep[%d]", projectID, family, keep)
+
+	if keep < 0 {
+		return nil, errors.Errorf("negative keep: family[%s], keep[%d]", family, keep)
+	}
+
+	versions, err := m.ListInstanceTemplateVersions(projectID, family)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) <= keep {
+		return []string{}, nil
+	}
+
+	referenced, err := m.referencedInstanceTemplates(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []string{}
+	for _, template := range versions[:len(versions)-keep] {
+		if referenced[template.Name] {
+			log.Debugf("Template in use: template[%s]", template.Name)
+			continue
+		}
+
+		op, err := m.DeleteInstanceTemplate(projectID, template.Name)
+		if isResourceInUse(err) {
+			log.Debugf("Template in use: template[%s]", template.Name)
+			continue
+		}
+		if err != nil {
+			return deleted, errors.Wrapf(err, "delete template fails: template[%s]", template.Name)
+		}
+		if err := m.WaitOperation(projectID, op); err != nil {
+			return deleted, errors.Wrapf(err, "delete template fails: template[%s]", template.Name)
+		}
+		deleted = append(deleted, template.Name)
+	}
+
+	return deleted, nil
+}
+
+// referencedInstanceTemplates returns the names of templates used by instance group managers of all zones
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.AggregatedList
+func (m *Manager) referencedInstanceTemplates(projectID string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	pageToken := ""
+	for {
+		call := m.Service.InstanceGroupManagers.AggregatedList(projectID)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, scoped := range res.Items {
+			for _, igm := range scoped.InstanceGroupManagers {
+				if igm.InstanceTemplate != "" {
+					referenced[formatutil.GetLastSplit(igm.InstanceTemplate, "/")] = true
+				}
+			}
+		}
+
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	return referenced, nil
+}
+
+// isResourceInUse reports whether the request is rejected since the resource is used by another one
+func isResourceInUse(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok || apiErr.Code != 400 {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "resourceInUseByAnotherResource" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deriveInstanceTemplate copies the base template with the new name and the overrides
+func deriveInstanceTemplate(
+	base *compute.InstanceTemplate, name string, overrides *TemplateOverrides) (*compute.InstanceTemplate, error) {
+
+	// deep copy through JSON
+	raw, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	template := &compute.InstanceTemplate{}
+	if err := json.Unmarshal(raw, template); err != nil {
+		return nil, err
+	}
+
+	template.Name = name
+	template.Id = 0
+	template.SelfLink = ""
+	template.CreationTimestamp = ""
+	if template.Properties == nil {
+		return nil, errors.Errorf("base template has no properties: template[%s]", base.Name)
+	}
+	if overrides == nil {
+		return template, nil
+	}
+
+	properties := template.Properties
+	if overrides.Image != "" {
+		found := false
+		for _, disk := range properties.Disks {
+			if disk.Boot && disk.InitializeParams != nil {
+				disk.InitializeParams.SourceImage = overrides.Image
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("base template has no boot disk to set image: template[%s]", base.Name)
+		}
+	}
+
+	if overrides.MachineType != "" {
+		properties.MachineType = overrides.MachineType
+	}
+
+	if len(overrides.Metadata) > 0 {
+		if properties.Metadata == nil {
+			properties.Metadata = &compute.Metadata{}
+		}
+		properties.Metadata.Fingerprint = ""
+		properties.Metadata.Items = mergeMetadata(properties.Metadata.Items, overrides.Metadata)
+	}
+
+	if overrides.Tags != nil {
+		properties.Tags = &compute.Tags{Items: overrides.Tags}
+	}
+
+	if len(overrides.Labels) > 0 {
+		if properties.Labels == nil {
+			properties.Labels = map[string]string{}
+		}
+		for key, value := range overrides.Labels {
+			properties.Labels[key] = value
+		}
+	}
+
+	if overrides.Description != "" {
+		template.Description = overrides.Description
+	}
+
+	return template, nil
+}
+
+// mergeMetadata overrides the items by metadata, the new keys are appended in the order of keys
+func mergeMetadata(items []*compute.MetadataItems, metadata map[string]string) []*compute.MetadataItems {
+	result := []*compute.MetadataItems{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if value, ok := metadata[item.Key]; ok {
+			v := value
+			item = &compute.MetadataItems{Key: item.Key, Value: &v}
+		}
+		seen[item.Key] = true
+		result = append(result, item)
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := metadata[key]
+		result = append(result, &compute.MetadataItems{Key: key, Value: &v})
+	}
+
+	return result
+}
+
+type byTemplateVersion struct {
+	family    string
+	templates []*compute.InstanceTemplate
+}
+
+func (a byTemplateVersion) Len() int { return len(a.templates) }
+func (a byTemplateVersion) Swap(i, j int) {
+	a.templates[i], a.templates[j] = a.templates[j], a.templates[i]
+}
+func (a byTemplateVersion) Less(i, j int) bool {
+	vi, _ := ParseTemplateVersion(a.family, a.templates[i].Name)
+	vj, _ := ParseTemplateVersion(a.family, a.templates[j].Name)
+	return vi < vj
+}
@@ -0,0 +1,265 @@
+package gce
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// VMTemplateFormatJSON renders the template as the JSON of compute.Instance
+	VMTemplateFormatJSON = "json"
+	// VMTemplateFormatYAML renders the template as the YAML of compute.Instance
+	VMTemplateFormatYAML = "yaml"
+)
+
+var (
+	resourceNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+	// the partial URLs, optionally with the project or the full API prefix
+	machineTypeURLPattern = regexp.MustCompile(`^` + resourceURLPrefix + `zones/[-a-z0-9]+/machineTypes/[-a-z0-9]+$`)
+	diskTypeURLPattern    = regexp.MustCompile(`^` + resourceURLPrefix + `zones/[-a-z0-9]+/diskTypes/[-a-z0-9]+$`)
+	diskURLPattern        = regexp.MustCompile(`^` + resourceURLPrefix + `zones/[-a-z0-9]+/disks/[-a-z0-9]+$`)
+	imageURLPattern       = regexp.MustCompile(`^` + resourceURLPrefix + `global/images/(family/)?[-a-z0-9]+$`)
+	networkURLPattern     = regexp.MustCompile(`^` + resourceURLPrefix + `global/networks/[-a-z0-9]+$`)
+	subnetworkURLPattern  = regexp.MustCompile(`^` + resourceURLPrefix + `regions/[-a-z0-9]+/subnetworks/[-a-z0-9]+$`)
+)
+
+const resourceURLPrefix = `(https://www\.googleapis\.com/compute/v1/)?(projects/[-a-z0-9.:]+/)?`
+
+// VMTemplateParams is the parameters of VM templates, e.g. {{.Zone}} or {{.Vars.env}}.
+// Beside the parameters, templates can use the functions:
+//   - file: reads the file relative to BaseDir, e.g. {{file "startup.sh" | json}}
+//   - json: encodes the value as JSON, which is a valid YAML scalar too
+//   - indent: indents the lines of a string, e.g. for YAML block scalars
+//
+// Int64 fields of compute.Instance are strings as in the API, e.g. diskSizeGb: "10".
+type VMTemplateParams struct {
+	ProjectID   string
+	Zone        string
+	Name        string
+	MachineType string
+	Image       string
+	Network     string
+	Metadata    map[string]string
+	// Vars is for any other variables
+	Vars map[string]interface{}
+
+	// BaseDir is the directory of files read by templates, the working directory if empty
+	BaseDir string
+	// Format is VMTemplateFormatJSON or VMTemplateFormatYAML, detected from the rendered template if empty
+	Format string
+}
+
+// InitVMFromTemplate builds the sample VM from template with {{.Zone}}
+func (m *Manager) InitVMFromTemplate(templateFile []byte, zone string) (*compute.Instance, error) {
+	return m.InitVMFromTemplateWithParams(templateFile, &VMTemplateParams{Zone: zone})
+}
+
+// InitVMFromTemplateFile builds the VM from the template file, files read by the template are relative to it
+func (m *Manager) InitVMFromTemplateFile(path string, params *VMTemplateParams) (*compute.Instance, error) {
+	templateFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read VM template fails: file[%s]", path)
+	}
+
+	p := VMTemplateParams{}
+	if params != nil {
+		p = *params
+	}
+	if p.BaseDir == "" {
+		p.BaseDir = filepath.Dir(path)
+	}
+	if p.Format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			p.Format = VMTemplateFormatYAML
+		case ".json":
+			p.Format = VMTemplateFormatJSON
+		}
+	}
+
+	vm, err := m.InitVMFromTemplateWithParams(templateFile, &p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file[%s]", path)
+	}
+
+	return vm, nil
+}
+
+// InitVMFromTemplateWithParams renders the template with params, then parses and validates the VM
+func (m *Manager) InitVMFromTemplateWithParams(
+	templateFile []byte, params *VMTemplateParams) (*compute.Instance, error) {
+
+	if params == nil {
+		params = &VMTemplateParams{}
+	}
+
+	rendered, err := renderVMTemplate(templateFile, params)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := parseVM(rendered, params.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateVM(vm); err != nil {
+		return nil, err
+	}
+	if params.Zone != "" && !strings.Contains(vm.MachineType, "zones/"+params.Zone+"/") {
+		return nil, errors.Errorf("invalid VM: machine type not in zone[%s]: machineType[%s]",
+			params.Zone, vm.MachineType)
+	}
+
+	log.Tracef("InitVMFromTemplateWithParams: VM[%s]", vm.Name)
+
+	return vm, nil
+}
+
+// ValidateVM validates the required fields and the URL formats of the VM to be created
+func ValidateVM(vm *compute.Instance) error {
+	if vm == nil {
+		return errors.New("invalid VM: empty")
+	}
+	if !resourceNamePattern.MatchString(vm.Name) {
+		return errors.Errorf("invalid VM: bad name[%s]", vm.Name)
+	}
+	if !machineTypeURLPattern.MatchString(vm.MachineType) {
+		return errors.Errorf("invalid VM: bad machineType[%s]", vm.MachineType)
+	}
+
+	if len(vm.Disks) == 0 {
+		return errors.New("invalid VM: no disk")
+	}
+	boot := 0
+	for i, disk := range vm.Disks {
+		if disk.Boot {
+			boot++
+		}
+		if err := validateAttachedDisk(disk); err != nil {
+			return errors.Wrapf(err, "invalid VM: disks[%d]", i)
+		}
+	}
+	if boot != 1 {
+		return errors.Errorf("invalid VM: %d boot disks", boot)
+	}
+
+	if len(vm.NetworkInterfaces) == 0 {
+		return errors.New("invalid VM: no network interface")
+	}
+	for i, nic := range vm.NetworkInterfaces {
+		if nic.Network == "" && nic.Subnetwork == "" {
+			return errors.Errorf("invalid VM: networkInterfaces[%d] has no network", i)
+		}
+		if nic.Network != "" && !networkURLPattern.MatchString(nic.Network) {
+			return errors.Errorf("invalid VM: networkInterfaces[%d] bad network[%s]", i, nic.Network)
+		}
+		if nic.Subnetwork != "" && !subnetworkURLPattern.MatchString(nic.Subnetwork) {
+			return errors.Errorf("invalid VM: networkInterfaces[%d] bad subnetwork[%s]", i, nic.Subnetwork)
+		}
+	}
+
+	return nil
+}
+
+// validateAttachedDisk requires the image of the boot disk, the data disk without image is blank.
+// The disks from snapshots are attached by source, initializeParams has no snapshot in compute v1.
+func validateAttachedDisk(disk *compute.AttachedDisk) error {
+	if disk.Source != "" {
+		if !diskURLPattern.MatchString(disk.Source) {
+			return errors.Errorf("bad source[%s]", disk.Source)
+		}
+		return nil
+	}
+
+	params := disk.InitializeParams
+	if params == nil {
+		return errors.New("neither source nor initializeParams")
+	}
+	if params.SourceImage == "" && disk.Boot {
+		return errors.New("boot disk without sourceImage")
+	}
+	if params.SourceImage != "" && !imageURLPattern.MatchString(params.SourceImage) {
+		return errors.Errorf("bad sourceImage[%s]", params.SourceImage)
+	}
+	if params.DiskType != "" && !diskTypeURLPattern.MatchString(params.DiskType) {
+		return errors.Errorf("bad diskType[%s]", params.DiskType)
+	}
+
+	return nil
+}
+
+func renderVMTemplate(templateFile []byte, params *VMTemplateParams) ([]byte, error) {
+	funcs := template.FuncMap{
+		"file": func(path string) (string, error) {
+			if !filepath.IsAbs(path) && params.BaseDir != "" {
+				path = filepath.Join(params.BaseDir, path)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return string(content), nil
+		},
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"indent": func(spaces int, s string) string {
+			pad := strings.Repeat(" ", spaces)
+			return pad + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n"+pad, -1)
+		},
+	}
+
+	tmpl, err := template.New("vm").Funcs(funcs).Option("missingkey=error").Parse(string(templateFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse VM template fails")
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, params); err != nil {
+		return nil, errors.Wrap(err, "execute VM template fails")
+	}
+
+	return b.Bytes(), nil
+}
+
+func parseVM(rendered []byte, format string) (*compute.Instance, error) {
+	if format == "" {
+		format = VMTemplateFormatYAML
+		if bytes.HasPrefix(bytes.TrimSpace(rendered), []byte("{")) {
+			format = VMTemplateFormatJSON
+		}
+	}
+
+	raw := rendered
+	switch format {
+	case VMTemplateFormatJSON:
+	case VMTemplateFormatYAML:
+		var err error
+		if raw, err = yaml.YAMLToJSON(rendered); err != nil {
+			return nil, errors.Wrap(err, "parse VM YAML fails")
+		}
+	default:
+		return nil, errors.Errorf("unknown VM template format[%s]", format)
+	}
+
+	vm := &compute.Instance{}
+	if err := json.Unmarshal(raw, vm); err != nil {
+		return nil, errors.Wrapf(err, "parse VM %s fails", format)
+	}
+
+	return vm, nil
+}
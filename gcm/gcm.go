@@ -3,8 +3,10 @@ package gcm
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
@@ -31,6 +33,9 @@ func BuildCloudMonitorService(serviceEmail string, key []byte) (*monitor.Service
 	return service, nil
 }
 
+// ErrNoTimeSeries is returned when there is no data point in the interval
+var ErrNoTimeSeries = errors.New("no time series")
+
 // Manager is for low level communication with Google CloudMonitor.
 type Manager struct {
 	*monitor.Service `inject:""`
@@ -56,6 +61,108 @@ func (m *Manager) GetAvgCPUUtilization(projectID, instanceName string) (float64,
 	if err != nil {
 		return 0.0, err
 	}
+	return latestDouble(response)
+}
+
+// GetMeanOfInstances gets the mean of the metric across the instances in recent window (at least 1 minute).
+// The instanceLabel is the label of the instance name, e.g. `metric.label.instance_name` of compute metrics.
+func (m *Manager) GetMeanOfInstances(
+	projectID, metricType, instanceLabel string, instances []string, window time.Duration) (float64, error) {
+
+	if len(instances) == 0 {
+		return 0.0, ErrNoTimeSeries
+	}
+	if window < time.Minute {
+		window = time.Minute
+	}
+
+	name := fmt.Sprintf("projects/%s", projectID)
+
+	quoted := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		quoted = append(quoted, fmt.Sprintf("\"%s\"", instance))
+	}
+	filter := fmt.Sprintf("metric.type = \"%s\" AND %s = one_of(%s)",
+		metricType, instanceLabel, strings.Join(quoted, ","))
+
+	response, err := m.Service.Projects.TimeSeries.List(name).
+		Filter(filter).
+		IntervalStartTime(time.Now().Add(-window).In(time.UTC).Format(time.RFC3339Nano)).
+		IntervalEndTime(time.Now().In(time.UTC).Format(time.RFC3339Nano)).
+		AggregationAlignmentPeriod(fmt.Sprintf("%ds", int64(window.Seconds()))).
+		AggregationPerSeriesAligner("ALIGN_MEAN").
+		AggregationCrossSeriesReducer("REDUCE_MEAN").Do()
+
+	if err != nil {
+		return 0.0, err
+	}
+	return latestDouble(response)
+}
+
+// CPUUtilizationChecker builds the checker which is satisfied if the average CPU utilization
+// of recent 3 minutes of the instance is under threshold (0 to 1). It's compatible with gce.VMConditionChecker.
+func (m *Manager) CPUUtilizationChecker(threshold float64) func(projectID, zone, instanceName string) (bool, error) {
+	return func(projectID, zone, instanceName string) (bool, error) {
+		value, err := m.GetAvgCPUUtilization(projectID, instanceName)
+		if err == ErrNoTimeSeries {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return value < threshold, nil
+	}
+}
+
+// GetCloudSQLReplicationLag gets the max replication lag in seconds of recent 3 minutes of the MySQL read replica
+func (m *Manager) GetCloudSQLReplicationLag(projectID, instanceName string) (float64, error) {
+	name := fmt.Sprintf("projects/%s", projectID)
+
+	holder := "metric.type = %s AND resource.label.database_id = %s"
+
+	filter := fmt.Sprintf(holder,
+		"\"cloudsql.googleapis.com/database/mysql/replication/seconds_behind_master\"",
+		fmt.Sprintf("\"%s:%s\"", projectID, instanceName))
+
+	response, err := m.Service.Projects.TimeSeries.List(name).
+		Filter(filter).
+		IntervalStartTime(time.Now().Add(-3 * time.Minute).In(time.UTC).Format(time.RFC3339Nano)).
+		IntervalEndTime(time.Now().In(time.UTC).Format(time.RFC3339Nano)).
+		AggregationAlignmentPeriod("180s").
+		AggregationPerSeriesAligner("ALIGN_MAX").Do()
+
+	if err != nil {
+		return 0.0, err
+	}
+	value, err := latestInt64(response)
+	return float64(value), err
+}
+
+// latestDouble gets the double value of the latest point, ErrNoTimeSeries if there is no point
+func latestDouble(response *monitor.ListTimeSeriesResponse) (float64, error) {
+	value := latestValue(response)
+	if value == nil || value.DoubleValue == nil {
+		return 0.0, ErrNoTimeSeries
+	}
+
+	return *value.DoubleValue, nil
+}
+
+// latestInt64 gets the int64 value of the latest point, ErrNoTimeSeries if there is no point
+func latestInt64(response *monitor.ListTimeSeriesResponse) (int64, error) {
+	value := latestValue(response)
+	if value == nil || value.Int64Value == nil {
+		return 0, ErrNoTimeSeries
+	}
+
+	return *value.Int64Value, nil
+}
+
+func latestValue(response *monitor.ListTimeSeriesResponse) *monitor.TypedValue {
+	if len(response.TimeSeries) == 0 || len(response.TimeSeries[0].Points) == 0 {
+		return nil
+	}
 
-	return response.TimeSeries[0].Points[0].Value.DoubleValue, nil
+	return response.TimeSeries[0].Points[0].Value
 }
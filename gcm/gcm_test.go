@@ -16,6 +16,7 @@ var tested Manager
 var testedProjectID string
 var testedZone string
 var vmName = flag.String("vm", "", "")
+var replicaName = flag.String("replica", "", "")
 
 func TestCloudMonitorTestSuite(t *testing.T) {
 	suite.Run(t, new(CloudMonitorTestSuite))
@@ -62,6 +63,17 @@ func (suite *CloudMonitorTestSuite) Test01_GetAvgCpuUtilization() {
 	log.Printf("value: %f", value)
 }
 
+// go test --replica=replica-1
+func (suite *CloudMonitorTestSuite) Test02_GetCloudSQLReplicationLag() {
+	if *replicaName == "" {
+		log.Printf("--replica flag not set")
+		return
+	}
+
+	value, err := tested.GetCloudSQLReplicationLag(testedProjectID, *replicaName)
+	log.Printf("value: %f, err: %v", value, err)
+}
+
 func (suite *CloudMonitorTestSuite) TearDownSuite() {
 	log.Println("======== TearDown  ========")
 }
@@ -0,0 +1,388 @@
+package gds
+
+import (
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+// Cache is the backend of the entity cache of Manager, e.g. LRUCache, memcache or redis.
+// An empty value means the entity is not found.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	// Set sets the value, ttl zero means no expiration
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(keys ...string)
+}
+
+// CacheStats is the hit/miss metrics of the entity cache
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+}
+
+// cacheGenerations is the number of invalidation generations shared by hashed cache keys
+const cacheGenerations = 256
+
+// entityCache caches the properties of entities in the backend
+type entityCache struct {
+	// counters are placed first for 64-bit alignment of atomic operations
+	hits         uint64
+	negativeHits uint64
+	misses       uint64
+
+	// generations are bumped on invalidation, so that a fill which read datastore before
+	// a concurrent invalidation is skipped instead of caching the stale entity
+	mu          sync.Mutex
+	generations [cacheGenerations]uint64
+
+	backend     Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+// EnableCache enables the read-through cache of Get/GetMulti, which is invalidated
+// by Put/PutUnique/PutMulti/Delete/DeleteMulti/DeleteAll of this manager.
+// Not found keys are cached for negativeTTL, zero negativeTTL disables negative caching.
+func (m *Manager) EnableCache(backend Cache, ttl, negativeTTL time.Duration) {
+	m.cache = &entityCache{
+		backend:     backend,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// DisableCache disables the cache
+func (m *Manager) DisableCache() {
+	m.cache = nil
+}
+
+// CacheStats returns the metrics of the cache, zero if the cache is not enabled
+func (m *Manager) CacheStats() CacheStats {
+	if m.cache == nil {
+		return CacheStats{}
+	}
+
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&m.cache.hits),
+		NegativeHits: atomic.LoadUint64(&m.cache.negativeHits),
+		Misses:       atomic.LoadUint64(&m.cache.misses),
+	}
+}
+
+func cacheKey(key *datastore.Key) string {
+	return "gds:" + key.Encode()
+}
+
+func generationIndex(ck string) int {
+	h := fnv.New32a()
+	h.Write([]byte(ck))
+	return int(h.Sum32() % cacheGenerations)
+}
+
+// generation returns the invalidation generation of the key, which should be taken before reading datastore
+func (c *entityCache) generation(key *datastore.Key) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generations[generationIndex(cacheKey(key))]
+}
+
+// fill sets the value unless the key has been invalidated since the generation
+func (c *entityCache) fill(key *datastore.Key, generation uint64, value []byte, ttl time.Duration) {
+	ck := cacheKey(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[generationIndex(ck)] != generation {
+		log.Debugf("Stale entity not cached: key[%s]", ck)
+		return
+	}
+	c.backend.Set(ck, value, ttl)
+}
+
+// get loads the cached entity into dst, returns false on miss.
+// ErrNoSuchEntity is returned on negative hit.
+func (c *entityCache) get(key *datastore.Key, dst interface{}) (bool, error) {
+	ck := cacheKey(key)
+
+	value, ok := c.backend.Get(ck)
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return false, nil
+	}
+	if len(value) == 0 {
+		atomic.AddUint64(&c.negativeHits, 1)
+		return true, datastore.ErrNoSuchEntity
+	}
+
+	var exported []exportedProperty
+	if err := json.Unmarshal(value, &exported); err != nil {
+		log.Warnf("Broken cache: key[%s], err[%s]", ck, err)
+		c.backend.Delete(ck)
+		atomic.AddUint64(&c.misses, 1)
+		return false, nil
+	}
+	props, err := decodeProperties(exported)
+	if err == nil {
+		err = loadEntity(dst, props)
+	}
+	if err != nil {
+		log.Warnf("Broken cache: key[%s], err[%s]", ck, err)
+		c.backend.Delete(ck)
+		atomic.AddUint64(&c.misses, 1)
+		return false, nil
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	return true, nil
+}
+
+// set caches the entity read from datastore at the generation
+func (c *entityCache) set(key *datastore.Key, generation uint64, src interface{}) {
+	props, err := saveEntity(src)
+	if err != nil {
+		log.Warnf("Entity not cached: key[%v], err[%s]", key, err)
+		return
+	}
+	exported, err := encodeProperties(props)
+	if err != nil {
+		log.Warnf("Entity not cached: key[%v], err[%s]", key, err)
+		return
+	}
+	value, err := json.Marshal(exported)
+	if err != nil {
+		log.Warnf("Entity not cached: key[%v], err[%s]", key, err)
+		return
+	}
+
+	c.fill(key, generation, value, c.ttl)
+}
+
+// setNotFound caches the key not found in datastore at the generation
+func (c *entityCache) setNotFound(key *datastore.Key, generation uint64) {
+	if c.negativeTTL <= 0 {
+		return
+	}
+
+	c.fill(key, generation, []byte{}, c.negativeTTL)
+}
+
+func (c *entityCache) invalidate(keys ...*datastore.Key) {
+	cks := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			cks = append(cks, cacheKey(key))
+		}
+	}
+	if len(cks) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ck := range cks {
+		c.generations[generationIndex(ck)]++
+	}
+	c.backend.Delete(cks...)
+}
+
+// getMulti loads the cached entities into the slice dst, and returns the indexes of missed keys.
+// The errors of negative hits are set into merr.
+func (c *entityCache) getMulti(keys []*datastore.Key, dst reflect.Value, merr datastore.MultiError) []int {
+	missed := []int{}
+	for i, key := range keys {
+		hit, err := c.get(key, entityPointer(dst.Index(i)))
+		if !hit {
+			missed = append(missed, i)
+			continue
+		}
+		if err != nil {
+			merr[i] = err
+		}
+	}
+
+	return missed
+}
+
+// getMultiCached is GetMulti through the cache
+func (m *Manager) getMultiCached(keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		// let datastore report the invalid arguments
+		return m.Client.GetMulti(context.Background(), keys, dst)
+	}
+
+	merr := make(datastore.MultiError, len(keys))
+	missed := m.cache.getMulti(keys, v, merr)
+	if len(missed) > 0 {
+		missedKeys := make([]*datastore.Key, len(missed))
+		generations := make([]uint64, len(missed))
+		missedDst := reflect.MakeSlice(v.Type(), len(missed), len(missed))
+		for j, i := range missed {
+			missedKeys[j] = keys[i]
+			generations[j] = m.cache.generation(keys[i])
+			missedDst.Index(j).Set(v.Index(i))
+		}
+
+		err := m.Client.GetMulti(context.Background(), missedKeys, missedDst.Interface())
+		me, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return err
+		}
+
+		for j, i := range missed {
+			v.Index(i).Set(missedDst.Index(j))
+			if isMulti && me[j] != nil {
+				merr[i] = me[j]
+				if me[j] == datastore.ErrNoSuchEntity {
+					m.cache.setNotFound(keys[i], generations[j])
+				}
+				continue
+			}
+			m.cache.set(keys[i], generations[j], entityPointer(v.Index(i)))
+		}
+	}
+
+	for _, err := range merr {
+		if err != nil {
+			return merr
+		}
+	}
+
+	return nil
+}
+
+// entityPointer returns the pointer to the element of the slice, nil pointer element is allocated
+func entityPointer(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Interface {
+		return v.Elem().Interface()
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	}
+
+	return v.Addr().Interface()
+}
+
+func loadEntity(dst interface{}, props []datastore.Property) error {
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+
+	return datastore.LoadStruct(dst, props)
+}
+
+func saveEntity(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+
+	return datastore.SaveStruct(src)
+}
+
+// LRUCache is the in-process Cache which evicts the least recently used entry
+type LRUCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewLRUCache builds the LRUCache keeping at most size entries
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// Get gets the value, expired entry is removed
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+
+	return entry.value, true
+}
+
+// Set sets the value and evicts the least recently used entries if the cache is full
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key, value, expiresAt})
+	for c.size > 0 && c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Delete deletes the values
+func (c *LRUCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// Len returns the number of entries including expired ones
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *LRUCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).key)
+}
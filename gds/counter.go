@@ -0,0 +1,107 @@
+package gds
+
+import (
+	"fmt"
+	"math/rand"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+const (
+	// CounterShardKind is the kind of shards of ShardedCounter
+	CounterShardKind = "GogooCounterShard"
+	// DefaultCounterShards is the default number of shards of ShardedCounter
+	DefaultCounterShards = 20
+)
+
+// counterShard is the entity of CounterShardKind keyed by `<counter>-<index>`
+type counterShard struct {
+	Counter string `datastore:"counter"`
+	Count   int64  `datastore:"count,noindex"`
+}
+
+// ShardedCounter spreads increments over shards to avoid contention on one entity.
+// The number of shards could be increased later but should never be decreased.
+type ShardedCounter struct {
+	Name   string
+	Shards int
+
+	m *Manager
+}
+
+// NewShardedCounter builds the counter of the name.
+// DefaultCounterShards is used if shards is not positive.
+func (m *Manager) NewShardedCounter(name string, shards int) *ShardedCounter {
+	if shards <= 0 {
+		shards = DefaultCounterShards
+	}
+
+	return &ShardedCounter{Name: name, Shards: shards, m: m}
+}
+
+// Increment adds delta to a random shard in a transaction
+func (c *ShardedCounter) Increment(delta int64) error {
+	key := c.shardKey(rand.Intn(c.Shards))
+
+	_, err := c.m.Client.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		shard := &counterShard{}
+		if err := tx.Get(key, shard); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		shard.Counter = c.Name
+		shard.Count += delta
+		_, err := tx.Put(key, shard)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "increment fails: counter[%s], shard[%s]", c.Name, key.Name())
+	}
+
+	return nil
+}
+
+// Count sums up all shards
+func (c *ShardedCounter) Count() (int64, error) {
+	log.Tracef("Count: counter[%s]", c.Name)
+
+	shards := make([]counterShard, c.Shards)
+	err := c.m.Client.GetMulti(context.Background(), c.shardKeys(), shards)
+	if me, ok := err.(datastore.MultiError); ok {
+		for _, shardErr := range me {
+			if shardErr != nil && shardErr != datastore.ErrNoSuchEntity {
+				return 0, errors.Wrapf(shardErr, "count fails: counter[%s]", c.Name)
+			}
+		}
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "count fails: counter[%s]", c.Name)
+	}
+
+	var sum int64
+	for _, shard := range shards {
+		sum += shard.Count
+	}
+
+	return sum, nil
+}
+
+// Delete deletes all shards of the counter
+func (c *ShardedCounter) Delete() error {
+	return c.m.DeleteMulti(c.shardKeys())
+}
+
+func (c *ShardedCounter) shardKey(index int) *datastore.Key {
+	return c.m.BuildKey(CounterShardKind+c.m.SuffixOfKind, fmt.Sprintf("%s-%d", c.Name, index))
+}
+
+func (c *ShardedCounter) shardKeys() []*datastore.Key {
+	keys := make([]*datastore.Key, c.Shards)
+	for i := range keys {
+		keys[i] = c.shardKey(i)
+	}
+
+	return keys
+}
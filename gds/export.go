@@ -0,0 +1,379 @@
+package gds
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/iKala/gogoo/storage"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+const (
+	// DefaultImportBatchSize is the default number of entities written by one batch of Import
+	DefaultImportBatchSize = MaxPutMultiSize
+	// maxExportLineSize is the max size of one exported entity (datastore entity is at most 1MB)
+	maxExportLineSize = 4 << 20
+)
+
+// Value types of exported properties
+const (
+	TypeNull   = "null"
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeFloat  = "float"
+	TypeTime   = "time"
+	TypeKey    = "key"
+	TypeBytes  = "bytes"
+	TypeGeo    = "geo"
+	TypeArray  = "array"
+)
+
+// exportedEntity is one line of the JSON Lines export.
+// Nested structs are saved by datastore as dotted property names, e.g. `author.name`,
+// so that they are round-tripped as ordinary properties.
+type exportedEntity struct {
+	Key        *exportedKey       `json:"key"`
+	Properties []exportedProperty `json:"properties"`
+}
+
+type exportedKey struct {
+	Kind      string       `json:"kind"`
+	Name      string       `json:"name,omitempty"`
+	ID        int64        `json:"id,omitempty,string"`
+	Namespace string       `json:"namespace,omitempty"`
+	Parent    *exportedKey `json:"parent,omitempty"`
+}
+
+type exportedProperty struct {
+	Name    string `json:"name"`
+	NoIndex bool   `json:"noindex,omitempty"`
+	exportedValue
+}
+
+type exportedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Export writes the query result to w as JSON Lines, one entity per line, and returns the number of entities
+func (m *Manager) Export(w io.Writer, query *datastore.Query) (int, error) {
+	log.Trace("Export by query")
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	count := 0
+	it := m.Client.Run(context.Background(), query)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return count, errors.Errorf("Failed fetching results: %v", err)
+		}
+
+		properties, err := encodeProperties(props)
+		if err != nil {
+			return count, errors.Wrapf(err, "key[%v]", key)
+		}
+		if err := encoder.Encode(exportedEntity{Key: encodeKey(key), Properties: properties}); err != nil {
+			return count, errors.Wrap(err, "write fails")
+		}
+		count++
+	}
+
+	if err := bw.Flush(); err != nil {
+		return count, errors.Wrap(err, "write fails")
+	}
+	log.Debugf("Exported: count[%d]", count)
+
+	return count, nil
+}
+
+// ExportKind writes all entities of the kind to w, see Export
+func (m *Manager) ExportKind(w io.Writer, kindName string) (int, error) {
+	return m.Export(w, datastore.NewQuery(kindName))
+}
+
+// Import reads JSON Lines written by Export and puts the entities with batched writes.
+// DefaultImportBatchSize is used if batchSize is not positive.
+func (m *Manager) Import(r io.Reader, batchSize int) (int, error) {
+	log.Trace("Import")
+
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxExportLineSize)
+
+	count := 0
+	line := 0
+	keys := []*datastore.Key{}
+	entities := []datastore.PropertyList{}
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if _, err := m.PutMulti(keys, entities); err != nil {
+			return err
+		}
+		count += len(keys)
+		keys = []*datastore.Key{}
+		entities = []datastore.PropertyList{}
+		return nil
+	}
+
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var en exportedEntity
+		if err := json.Unmarshal(scanner.Bytes(), &en); err != nil {
+			return count, errors.Wrapf(err, "line[%d]", line)
+		}
+		if en.Key == nil {
+			return count, errors.Errorf("missing key: line[%d]", line)
+		}
+		props, err := decodeProperties(en.Properties)
+		if err != nil {
+			return count, errors.Wrapf(err, "line[%d]", line)
+		}
+
+		keys = append(keys, decodeKey(en.Key))
+		entities = append(entities, props)
+		if len(keys) >= batchSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, errors.Wrap(err, "read fails")
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	log.Debugf("Imported: count[%d]", count)
+
+	return count, nil
+}
+
+// ExportToStorage exports the query result to the google storage object
+func (m *Manager) ExportToStorage(sm *storage.Manager, bucketName, objectName string, query *datastore.Query) (int, error) {
+	log.Tracef("ExportToStorage: bucket[%s], object[%s]", bucketName, objectName)
+
+	pr, pw := io.Pipe()
+
+	type result struct {
+		count int
+		err   error
+	}
+	exported := make(chan result, 1)
+	go func() {
+		count, err := m.Export(pw, query)
+		pw.CloseWithError(err)
+		exported <- result{count, err}
+	}()
+
+	_, uploadErr := sm.Upload(bucketName, objectName, pr)
+	pr.CloseWithError(uploadErr)
+
+	res := <-exported
+	if res.err != nil {
+		return res.count, res.err
+	}
+	if uploadErr != nil {
+		return res.count, errors.Wrapf(uploadErr, "upload fails: bucket[%s], object[%s]", bucketName, objectName)
+	}
+
+	return res.count, nil
+}
+
+// ImportFromStorage imports the entities from the google storage object written by ExportToStorage
+func (m *Manager) ImportFromStorage(sm *storage.Manager, bucketName, objectName string, batchSize int) (int, error) {
+	log.Tracef("ImportFromStorage: bucket[%s], object[%s]", bucketName, objectName)
+
+	r, err := sm.Download(bucketName, objectName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "download fails: bucket[%s], object[%s]", bucketName, objectName)
+	}
+	defer r.Close()
+
+	return m.Import(r, batchSize)
+}
+
+func encodeKey(key *datastore.Key) *exportedKey {
+	if key == nil {
+		return nil
+	}
+
+	return &exportedKey{
+		Kind:      key.Kind(),
+		Name:      key.Name(),
+		ID:        key.ID(),
+		Namespace: key.Namespace(),
+		Parent:    encodeKey(key.Parent()),
+	}
+}
+
+func decodeKey(ek *exportedKey) *datastore.Key {
+	if ek == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	if ek.Namespace != "" {
+		ctx = datastore.WithNamespace(ctx, ek.Namespace)
+	}
+
+	return datastore.NewKey(ctx, ek.Kind, ek.Name, ek.ID, decodeKey(ek.Parent))
+}
+
+func encodeProperties(props []datastore.Property) ([]exportedProperty, error) {
+	result := make([]exportedProperty, 0, len(props))
+	for _, p := range props {
+		ev, err := encodeValue(p.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "property[%s]", p.Name)
+		}
+		result = append(result, exportedProperty{Name: p.Name, NoIndex: p.NoIndex, exportedValue: ev})
+	}
+
+	return result, nil
+}
+
+func decodeProperties(props []exportedProperty) (datastore.PropertyList, error) {
+	result := make(datastore.PropertyList, 0, len(props))
+	for _, p := range props {
+		value, err := decodeValue(p.exportedValue)
+		if err != nil {
+			return nil, errors.Wrapf(err, "property[%s]", p.Name)
+		}
+		result = append(result, datastore.Property{Name: p.Name, Value: value, NoIndex: p.NoIndex})
+	}
+
+	return result, nil
+}
+
+func encodeValue(v interface{}) (exportedValue, error) {
+	var t string
+	var raw interface{}
+
+	switch value := v.(type) {
+	case nil:
+		return exportedValue{Type: TypeNull}, nil
+	case string:
+		t, raw = TypeString, value
+	case int64:
+		// as string to keep the precision in JSON
+		t, raw = TypeInt, strconv.FormatInt(value, 10)
+	case bool:
+		t, raw = TypeBool, value
+	case float64:
+		t, raw = TypeFloat, value
+	case time.Time:
+		t, raw = TypeTime, value.UTC().Format(time.RFC3339Nano)
+	case *datastore.Key:
+		t, raw = TypeKey, encodeKey(value)
+	case []byte:
+		t, raw = TypeBytes, base64.StdEncoding.EncodeToString(value)
+	case datastore.GeoPoint:
+		t, raw = TypeGeo, value
+	case []interface{}:
+		values := make([]exportedValue, 0, len(value))
+		for _, elem := range value {
+			ev, err := encodeValue(elem)
+			if err != nil {
+				return exportedValue{}, err
+			}
+			values = append(values, ev)
+		}
+		t, raw = TypeArray, values
+	default:
+		return exportedValue{}, errors.Errorf("unsupported value type: %T", v)
+	}
+
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return exportedValue{}, err
+	}
+
+	return exportedValue{Type: t, Value: b}, nil
+}
+
+func decodeValue(ev exportedValue) (interface{}, error) {
+	switch ev.Type {
+	case TypeNull:
+		return nil, nil
+	case TypeString:
+		var s string
+		err := json.Unmarshal(ev.Value, &s)
+		return s, err
+	case TypeInt:
+		var s string
+		if err := json.Unmarshal(ev.Value, &s); err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case TypeBool:
+		var b bool
+		err := json.Unmarshal(ev.Value, &b)
+		return b, err
+	case TypeFloat:
+		var f float64
+		err := json.Unmarshal(ev.Value, &f)
+		return f, err
+	case TypeTime:
+		var s string
+		if err := json.Unmarshal(ev.Value, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case TypeKey:
+		var ek exportedKey
+		if err := json.Unmarshal(ev.Value, &ek); err != nil {
+			return nil, err
+		}
+		return decodeKey(&ek), nil
+	case TypeBytes:
+		var s string
+		if err := json.Unmarshal(ev.Value, &s); err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case TypeGeo:
+		var g datastore.GeoPoint
+		err := json.Unmarshal(ev.Value, &g)
+		return g, err
+	case TypeArray:
+		var values []exportedValue
+		if err := json.Unmarshal(ev.Value, &values); err != nil {
+			return nil, err
+		}
+		result := make([]interface{}, 0, len(values))
+		for _, elem := range values {
+			v, err := decodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, nil
+	}
+
+	return nil, errors.Errorf("unsupported value type: %s", ev.Type)
+}
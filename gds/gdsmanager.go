@@ -21,8 +21,13 @@ type Cloneable interface {
 // Manager is for low level communication with Google datastore
 type Manager struct {
 	SuffixOfKind string
+	// MultiWorkers is the number of concurrent calls issued by PutMulti/DeleteMulti.
+	// DefaultMultiWorkers is used if it is not positive.
+	MultiWorkers int
 
 	Client *datastore.Client `inject:""`
+
+	cache *entityCache
 }
 
 // Setup sets the suffix of kind
@@ -35,6 +40,33 @@ func (m *Manager) BuildKey(kind, keyName string) *datastore.Key {
 	return datastore.NewKey(context.Background(), kind, keyName, 0, nil)
 }
 
+// AllocateIDs reserves n IDs of the kind under parent (nil for root entities),
+// and returns the complete keys which could be used by Put later
+func (m *Manager) AllocateIDs(kind string, parent *datastore.Key, n int) ([]*datastore.Key, error) {
+	log.Tracef("AllocateIDs: kind[%s], n[%d]", kind, n)
+
+	result := make([]*datastore.Key, 0, n)
+	for len(result) < n {
+		size := n - len(result)
+		if size > MaxPutMultiSize {
+			size = MaxPutMultiSize
+		}
+
+		incompleteKeys := make([]*datastore.Key, size)
+		for i := range incompleteKeys {
+			incompleteKeys[i] = datastore.NewIncompleteKey(context.Background(), kind, parent)
+		}
+
+		keys, err := m.Client.AllocateIDs(context.Background(), incompleteKeys)
+		if err != nil {
+			return nil, errors.Wrapf(err, "kind[%s]", kind)
+		}
+		result = append(result, keys...)
+	}
+
+	return result, nil
+}
+
 // Put inserts/updates the entity
 func (m *Manager) Put(key *datastore.Key, entity interface{}) (*datastore.Key, error) {
 	var resultKey *datastore.Key
@@ -44,12 +76,12 @@ func (m *Manager) Put(key *datastore.Key, entity interface{}) (*datastore.Key, e
 	}
 	resultKey = key
 
-	// Use reflection to setup key of entity
-	f := reflect.ValueOf(entity).Elem().FieldByName("Key")
-	if f.IsValid() && f.CanSet() {
-		f.Set(reflect.ValueOf(key))
+	if m.cache != nil {
+		m.cache.invalidate(key)
 	}
 
+	setEntityKey(reflect.ValueOf(entity), key)
+
 	return resultKey, nil
 }
 
@@ -72,6 +104,10 @@ func (m *Manager) PutUnique(key *datastore.Key, entity interface{}) error {
 		return errors.Wrap(err, "commit fails")
 	}
 
+	if m.cache != nil {
+		m.cache.invalidate(key)
+	}
+
 	return nil
 }
 
@@ -79,22 +115,44 @@ func (m *Manager) PutUnique(key *datastore.Key, entity interface{}) error {
 func (m *Manager) Get(key *datastore.Key, entity interface{}) error {
 	log.Tracef("Get entity: key[%s]", key.Name())
 
+	if m.cache != nil {
+		if hit, err := m.cache.get(key, entity); hit {
+			if err != nil {
+				return errors.Wrapf(err, "kind[%s], key[%s]", key.Kind(), key.Name())
+			}
+			setEntityKey(reflect.ValueOf(entity), key)
+			return nil
+		}
+	}
+
+	var generation uint64
+	if m.cache != nil {
+		generation = m.cache.generation(key)
+	}
+
 	err := m.Client.Get(context.Background(), key, entity)
 	if err != nil {
+		if err == datastore.ErrNoSuchEntity && m.cache != nil {
+			m.cache.setNotFound(key, generation)
+		}
 		return errors.Wrapf(err, "kind[%s], key[%s]", key.Kind(), key.Name())
 	}
 
-	// Use reflection to setup key of entity
-	f := reflect.ValueOf(entity).Elem().FieldByName("Key")
-	if f.IsValid() && f.CanSet() {
-		f.Set(reflect.ValueOf(key))
+	if m.cache != nil {
+		m.cache.set(key, generation, entity)
 	}
 
+	setEntityKey(reflect.ValueOf(entity), key)
+
 	return nil
 }
 
 // GetMulti gets the entities by keys
 func (m *Manager) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	if m.cache != nil {
+		return m.getMultiCached(keys, dst)
+	}
+
 	err := m.Client.GetMulti(context.Background(), keys, dst)
 	if err != nil {
 		return err
@@ -207,6 +265,10 @@ func (m *Manager) Delete(key *datastore.Key) error {
 		return err
 	}
 
+	if m.cache != nil {
+		m.cache.invalidate(key)
+	}
+
 	return nil
 }
 
@@ -222,10 +284,7 @@ func (m *Manager) GetAll(query *datastore.Query, result interface{}) ([]*datasto
 	// Use reflection to setup keys of entities
 	s := reflect.ValueOf(result).Elem()
 	for i := 0; i < s.Len(); i++ {
-		f := s.Index(i).Elem().FieldByName("Key")
-		if f.IsValid() && f.CanSet() {
-			f.Set(reflect.ValueOf(keys[i]))
-		}
+		setEntityKey(s.Index(i), keys[i])
 	}
 
 	return keys, nil
@@ -247,24 +306,12 @@ func (m *Manager) GetCount(query *datastore.Query) (int, error) {
 func (m *Manager) DeleteAll(kindName string) error {
 	log.Trace("Delete all")
 
-	query := datastore.NewQuery(kindName).KeysOnly()
-
-	type Any struct{}
-	result := &[]Any{}
-
-	keys, err := m.GetAll(query, result)
+	keys, err := m.GetKeysOnly(datastore.NewQuery(kindName))
 	if err != nil {
 		return err
 	}
 
-	for _, key := range keys {
-		err = m.Delete(key)
-		if err != nil {
-			log.Warnf("Delete fails: key[%s]", key.Name())
-		}
-	}
-
-	return nil
+	return m.DeleteMulti(keys)
 }
 
 // GetTx gets the datastore transaction
@@ -1,10 +1,13 @@
 package gds
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,7 +24,10 @@ var testedProjectID string
 var testedZone string
 
 const (
-	TestKind = "TestKind"
+	TestKind          = "TestKind"
+	TestMultiKind     = "TestMultiKind"
+	TestMigrationKind = "TestMigrationKind"
+	TestExportKind    = "TestExportKind"
 )
 
 type Article struct {
@@ -35,6 +41,11 @@ func (a *Article) Clone() interface{} {
 	return *a
 }
 
+type Comment struct {
+	ID   *datastore.Key `datastore:"-" gds:"key"`
+	Body string         `datastore:"body"`
+}
+
 func TestGdsManagerTestSuite(t *testing.T) {
 	suite.Run(t, new(GdsManagerTestSuite))
 }
@@ -234,6 +245,69 @@ func (suite *GdsManagerTestSuite) Test_BatchIterate() {
 	tested.BatchIterate(query, 1, &Article{}, op)
 }
 
+func (suite *GdsManagerTestSuite) Test_StreamIterate() {
+	checkpointer := tested.NewCheckpointer("test-stream-iterate")
+	defer checkpointer.Reset()
+
+	var processed int32
+	op := func(ctx context.Context, key *datastore.Key, dst interface{}) error {
+		atomic.AddInt32(&processed, 1)
+		return nil
+	}
+	progressCount := 0
+	opts := IterateOptions{
+		Workers:    2,
+		BatchSize:  1,
+		Checkpoint: checkpointer,
+		Progress: func(p IterateProgress) {
+			progressCount++
+		},
+	}
+
+	query := datastore.NewQuery(TestKind).Filter("number <", 100)
+	err := tested.StreamIterate(context.Background(), query, &Article{}, op, opts)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int32(2), processed)
+	assert.Equal(suite.T(), 3, progressCount)
+
+	// resumed iteration does nothing after done
+	err = tested.StreamIterate(context.Background(), query, &Article{}, op, opts)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int32(2), processed)
+
+	// failures are collected
+	failedOp := func(ctx context.Context, key *datastore.Key, dst interface{}) error {
+		return fmt.Errorf("failed: key[%s]", key.Name())
+	}
+	err = tested.StreamIterate(context.Background(), query, &Article{}, failedOp, IterateOptions{})
+	merr, ok := err.(MultiError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 2, len(merr))
+
+	// checkpoint stays before the failed batch, so the failed entities are processed on resume
+	failedCheckpointer := tested.NewCheckpointer("test-stream-iterate-failed")
+	defer failedCheckpointer.Reset()
+	failedOpts := IterateOptions{BatchSize: 1, Checkpoint: failedCheckpointer}
+	err = tested.StreamIterate(context.Background(), query, &Article{}, failedOp, failedOpts)
+	assert.NotNil(suite.T(), err)
+	cursor, done, err := failedCheckpointer.Load()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "", cursor)
+	assert.False(suite.T(), done)
+
+	processed = 0
+	err = tested.StreamIterate(context.Background(), query, &Article{}, op, failedOpts)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int32(2), processed)
+
+	// stop on first error
+	err = tested.StreamIterate(context.Background(), query, &Article{}, failedOp,
+		IterateOptions{Workers: 1, BatchSize: 1, StopOnError: true})
+	merr, ok = err.(MultiError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 1, len(merr))
+}
+
 func (suite *GdsManagerTestSuite) Test_Delete() {
 	// prepare
 	newKey := datastore.NewKey(context.Background(), TestKind, "instance-z", 0, nil)
@@ -260,6 +334,402 @@ func (suite *GdsManagerTestSuite) Test_Delete() {
 	tested.Delete(newKey)
 }
 
+func (suite *GdsManagerTestSuite) Test_PutMultiThenDeleteMulti() {
+	// more than one chunk
+	num := MaxPutMultiSize*2 + 10
+	keys := make([]*datastore.Key, num)
+	articles := make([]*Article, num)
+	for i := 0; i < num; i++ {
+		keys[i] = datastore.NewKey(context.Background(), TestMultiKind, fmt.Sprintf("multi-%d", i), 0, nil)
+		articles[i] = &Article{
+			Title:       fmt.Sprintf("title-%d", i),
+			Number:      i,
+			PublishedAt: time.Now(),
+		}
+	}
+
+	resultKeys, err := tested.PutMulti(keys, articles)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), num, len(resultKeys))
+	assert.Equal(suite.T(), "multi-3", articles[3].Key.Name())
+
+	count, _ := tested.GetCount(datastore.NewQuery(TestMultiKind))
+	assert.Equal(suite.T(), num, count)
+
+	err = tested.DeleteMulti(keys)
+	assert.Nil(suite.T(), err)
+
+	count, _ = tested.GetCount(datastore.NewQuery(TestMultiKind))
+	assert.Equal(suite.T(), 0, count)
+
+	// length mismatch
+	_, err = tested.PutMulti(keys[:1], articles)
+	assert.NotNil(suite.T(), err)
+
+	// failed keys are reported
+	_, err = tested.PutMulti([]*datastore.Key{keys[0], nil}, articles[:2])
+	merr, ok := err.(MultiError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 2, len(merr))
+	assert.Equal(suite.T(), 1, merr[1].Index)
+
+	tested.DeleteAll(TestMultiKind)
+}
+
+func (suite *GdsManagerTestSuite) Test_Repository() {
+	articles, err := NewRepository[Article](&tested, TestKind)
+	assert.Nil(suite.T(), err)
+	comments, err := NewRepository[Comment](&tested, "")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "Comment", comments.Kind())
+
+	// not a struct
+	_, err = NewRepository[string](&tested, "")
+	assert.NotNil(suite.T(), err)
+
+	// Get with key field setup
+	article, err := articles.Get(articles.NameKey("instance-1", nil))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "instance-1", article.Key.Name())
+
+	// kind mismatch
+	_, err = articles.Get(comments.NameKey("instance-1", nil))
+	assert.NotNil(suite.T(), err)
+
+	// Put with parent key and allocated ID
+	comment := &Comment{ID: comments.IncompleteKey(article.Key), Body: "body-1"}
+	key, err := comments.Put(comment)
+	assert.Nil(suite.T(), err)
+	assert.NotZero(suite.T(), comment.ID.ID())
+	assert.Equal(suite.T(), "instance-1", key.Parent().Name())
+
+	// Query under ancestor
+	result, err := comments.Query(comments.AncestorQuery(article.Key))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(result))
+	assert.Equal(suite.T(), "body-1", result[0].Body)
+	assert.Equal(suite.T(), key.ID(), result[0].ID.ID())
+
+	// Delete
+	assert.Nil(suite.T(), comments.Delete(key))
+	_, err = comments.Get(key)
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *GdsManagerTestSuite) Test_QueryBuilderPage() {
+	qb := tested.NewQueryBuilder(TestKind).
+		Filter("number", "<", 100).
+		Order("number").
+		Limit(1)
+
+	// first page
+	result := []*Article{}
+	page, err := qb.Page("", &result)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, len(result))
+	assert.NotNil(suite.T(), result[0].Key)
+	assert.NotEmpty(suite.T(), page.NextPageToken)
+	first := result[0]
+
+	// second page replaces the first one
+	page, err = qb.Page(page.NextPageToken, &result)
+	assert.Nil(suite.T(), err)
+	if assert.Equal(suite.T(), 1, len(result)) {
+		assert.NotEqual(suite.T(), first.Key, result[0].Key)
+		assert.True(suite.T(), first.Number <= result[0].Number)
+	}
+
+	// token reused on a different query
+	_, err = qb.Filter("title", "=", "title-1").Page(page.NextPageToken, &result)
+	assert.Equal(suite.T(), ErrPageTokenMismatch, err)
+
+	// page size doesn't change fingerprint
+	assert.Equal(suite.T(), qb.Fingerprint(), qb.Limit(10).Fingerprint())
+
+	// broken token
+	_, err = qb.Page("not-a-token", &result)
+	assert.Equal(suite.T(), ErrInvalidPageToken, err)
+}
+
+func (suite *GdsManagerTestSuite) Test_Migrator() {
+	defer tested.DeleteAll(TestMigrationKind)
+	defer tested.DeleteAll(MigrationKind)
+
+	for i := 0; i < 3; i++ {
+		key := datastore.NewKey(context.Background(), TestMigrationKind, fmt.Sprintf("migration-%d", i), 0, nil)
+		tested.Put(key, &Article{Title: "title", Number: i, PublishedAt: time.Now()})
+	}
+
+	mg := tested.NewMigrator()
+	mg.BatchSize = 2
+	err := mg.Register(Migration{
+		Version:     1,
+		Description: "rename title to headline",
+		Kind:        TestMigrationKind,
+		Migrate:     RenameProperty("title", "headline"),
+	})
+	assert.Nil(suite.T(), err)
+
+	// duplicated version
+	err = mg.Register(Migration{Version: 1, Kind: TestMigrationKind, Migrate: RenameProperty("a", "b")})
+	assert.NotNil(suite.T(), err)
+
+	// dry run writes nothing
+	reports, err := mg.Run(true)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, reports[0].Changed)
+	count, _ := tested.GetCount(datastore.NewQuery(TestMigrationKind).Filter("title =", "title"))
+	assert.Equal(suite.T(), 3, count)
+
+	reports, err = mg.Run(false)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, reports[0].Scanned)
+	assert.Equal(suite.T(), 3, reports[0].Changed)
+	count, _ = tested.GetCount(datastore.NewQuery(TestMigrationKind).Filter("headline =", "title"))
+	assert.Equal(suite.T(), 3, count)
+
+	// finished migration is not run again
+	reports, err = mg.Run(false)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), reports[0].Done)
+}
+
+func (suite *GdsManagerTestSuite) Test_MigratorSuffixOfKind() {
+	suffixed := &Manager{SuffixOfKind: "Suffixed", Client: tested.Client}
+	defer tested.DeleteAll(TestMigrationKind + suffixed.SuffixOfKind)
+	defer tested.DeleteAll(MigrationKind + suffixed.SuffixOfKind)
+
+	key := datastore.NewKey(context.Background(), TestMigrationKind+suffixed.SuffixOfKind, "migration-suffixed", 0, nil)
+	tested.Put(key, &Article{Title: "title", PublishedAt: time.Now()})
+
+	mg := suffixed.NewMigrator()
+	err := mg.Register(Migration{Version: 1, Kind: TestMigrationKind, Migrate: RenameProperty("title", "headline")})
+	assert.Nil(suite.T(), err)
+
+	reports, err := mg.Run(false)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, reports[0].Changed)
+	count, _ := tested.GetCount(
+		datastore.NewQuery(TestMigrationKind+suffixed.SuffixOfKind).Filter("headline =", "title"))
+	assert.Equal(suite.T(), 1, count)
+}
+
+func (suite *GdsManagerTestSuite) Test_ExportThenImport() {
+	// prepare the dedicated kind, so that the shared fixtures are untouched
+	original := &Article{
+		Title:       "title-export",
+		Number:      20,
+		PublishedAt: time.Now().Truncate(time.Microsecond),
+	}
+	originalKey := datastore.NewKey(context.Background(), TestExportKind, "instance-1", 0, nil)
+	_, err := tested.Put(originalKey, original)
+	assert.Nil(suite.T(), err)
+	defer tested.DeleteAll(TestExportKind)
+
+	var buf bytes.Buffer
+	count, err := tested.ExportKind(&buf, TestExportKind)
+	assert.Nil(suite.T(), err)
+	assert.NotZero(suite.T(), count)
+	assert.Equal(suite.T(), count, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	// import into a clean kind
+	tested.DeleteAll(TestExportKind)
+
+	imported, err := tested.Import(&buf, 1)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), count, imported)
+
+	entity := &Article{}
+	err = tested.Get(originalKey, entity)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), original.Title, entity.Title)
+	assert.Equal(suite.T(), original.Number, entity.Number)
+	assert.True(suite.T(), original.PublishedAt.Equal(entity.PublishedAt))
+}
+
+func (suite *GdsManagerTestSuite) Test_EncodeDecodeValue() {
+	parent := datastore.NewKey(context.Background(), TestKind, "parent", 0, nil)
+	values := []interface{}{
+		nil,
+		"string",
+		int64(1) << 60,
+		true,
+		1.5,
+		time.Date(2016, 6, 1, 12, 0, 0, 123456000, time.UTC),
+		datastore.NewKey(context.Background(), TestKind, "", 42, parent),
+		[]byte("bytes"),
+		datastore.GeoPoint{Lat: 25.03, Lng: 121.56},
+		[]interface{}{"a", int64(2)},
+	}
+
+	for _, v := range values {
+		ev, err := encodeValue(v)
+		assert.Nil(suite.T(), err)
+		decoded, err := decodeValue(ev)
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), v, decoded)
+	}
+
+	// unsupported type
+	_, err := encodeValue(struct{}{})
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *GdsManagerTestSuite) Test_Cache() {
+	cached := Manager{Client: tested.Client}
+	cached.EnableCache(NewLRUCache(10), time.Minute, time.Minute)
+
+	key := datastore.NewKey(context.Background(), TestKind, "instance-1", 0, nil)
+
+	// miss then hit
+	entity := &Article{}
+	assert.Nil(suite.T(), cached.Get(key, entity))
+	hit := &Article{}
+	assert.Nil(suite.T(), cached.Get(key, hit))
+	assert.Equal(suite.T(), entity.Title, hit.Title)
+	assert.Equal(suite.T(), key, hit.Key)
+	assert.Equal(suite.T(), CacheStats{Hits: 1, Misses: 1}, cached.CacheStats())
+
+	// invalidated by put
+	hit.Title = "title-cached"
+	cached.Put(key, hit)
+	assert.Nil(suite.T(), cached.Get(key, entity))
+	assert.Equal(suite.T(), "title-cached", entity.Title)
+	assert.Equal(suite.T(), uint64(2), cached.CacheStats().Misses)
+	entity.Title = "title-1"
+	cached.Put(key, entity)
+
+	// negative caching
+	notExisted := datastore.NewKey(context.Background(), TestKind, "not-existed", 0, nil)
+	assert.NotNil(suite.T(), cached.Get(notExisted, &Article{}))
+	assert.NotNil(suite.T(), cached.Get(notExisted, &Article{}))
+	assert.Equal(suite.T(), uint64(1), cached.CacheStats().NegativeHits)
+
+	// GetMulti mixes hits and misses
+	key2 := datastore.NewKey(context.Background(), TestKind, "instance-2", 0, nil)
+	result := make([]Article, 2)
+	assert.Nil(suite.T(), cached.GetMulti([]*datastore.Key{key, key2}, result))
+	assert.Equal(suite.T(), "title-1", result[0].Title)
+	assert.Equal(suite.T(), "title-2", result[1].Title)
+}
+
+func (suite *GdsManagerTestSuite) Test_CacheStaleFill() {
+	cache := NewLRUCache(10)
+	cached := Manager{}
+	cached.EnableCache(cache, 0, time.Minute)
+
+	key := datastore.NewKey(context.Background(), TestKind, "instance-1", 0, nil)
+
+	// the entity read before a concurrent invalidation is not cached
+	generation := cached.cache.generation(key)
+	cached.cache.invalidate(key)
+	cached.cache.set(key, generation, &Article{Title: "stale"})
+	cached.cache.setNotFound(key, generation)
+	assert.Equal(suite.T(), 0, cache.Len())
+
+	// the entity read after the invalidation is cached
+	cached.cache.set(key, cached.cache.generation(key), &Article{Title: "fresh"})
+	assert.Equal(suite.T(), 1, cache.Len())
+}
+
+func (suite *GdsManagerTestSuite) Test_LRUCache() {
+	cache := NewLRUCache(2)
+	cache.Set("a", []byte("a"), 0)
+	cache.Set("b", []byte("b"), 0)
+	cache.Get("a")
+	cache.Set("c", []byte("c"), 0)
+
+	// b is evicted as the least recently used
+	_, ok := cache.Get("b")
+	assert.False(suite.T(), ok)
+	value, ok := cache.Get("a")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "a", string(value))
+	assert.Equal(suite.T(), 2, cache.Len())
+
+	// expired
+	cache.Set("d", []byte("d"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = cache.Get("d")
+	assert.False(suite.T(), ok)
+
+	cache.Delete("a", "c")
+	assert.Equal(suite.T(), 0, cache.Len())
+}
+
+func (suite *GdsManagerTestSuite) Test_Lease() {
+	defer tested.DeleteAll(LeaseKind)
+
+	leaseA, err := tested.AcquireLease("test-lease", "owner-a", time.Minute)
+	assert.Nil(suite.T(), err)
+
+	// held by another owner
+	_, err = tested.AcquireLease("test-lease", "owner-b", time.Minute)
+	assert.Equal(suite.T(), ErrLeaseHeld, err)
+
+	assert.Nil(suite.T(), leaseA.Renew())
+	assert.Nil(suite.T(), leaseA.Release())
+
+	// fencing token increases
+	leaseB, err := tested.AcquireLease("test-lease", "owner-b", time.Second)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), leaseA.Token+1, leaseB.Token)
+
+	// expired lease could be taken over
+	time.Sleep(2 * time.Second)
+	leaseA, err = tested.AcquireLease("test-lease", "owner-a", time.Minute)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), ErrLeaseLost, leaseB.Renew())
+	select {
+	case <-leaseB.Lost():
+	default:
+		suite.T().Error("lease should be lost")
+	}
+
+	// automatic renewal
+	leaseA.KeepAlive(100 * time.Millisecond)
+	expiresAt := leaseA.ExpiresAt()
+	time.Sleep(time.Second)
+	assert.True(suite.T(), leaseA.ExpiresAt().After(expiresAt))
+	assert.Nil(suite.T(), leaseA.Release())
+}
+
+func (suite *GdsManagerTestSuite) Test_ShardedCounter() {
+	counter := tested.NewShardedCounter("test-counter", 3)
+	defer counter.Delete()
+
+	count, err := counter.Count()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), count)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(suite.T(), counter.Increment(2))
+		}()
+	}
+	wg.Wait()
+
+	count, err = counter.Count()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(20), count)
+}
+
+func (suite *GdsManagerTestSuite) Test_AllocateIDs() {
+	keys, err := tested.AllocateIDs(TestKind, nil, MaxPutMultiSize+1)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), MaxPutMultiSize+1, len(keys))
+
+	ids := map[int64]bool{}
+	for _, key := range keys {
+		assert.False(suite.T(), key.Incomplete())
+		ids[key.ID()] = true
+	}
+	assert.Equal(suite.T(), len(keys), len(ids))
+}
+
 func (suite *GdsManagerTestSuite) TearDownSuite() {
 	log.Println("======== TearDown  ========")
 
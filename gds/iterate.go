@@ -0,0 +1,258 @@
+package gds
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+const (
+	// DefaultIterateWorkers is the default number of concurrent op calls of StreamIterate
+	DefaultIterateWorkers = 8
+	// DefaultIterateBatchSize is the default number of entities fetched by one query of StreamIterate
+	DefaultIterateBatchSize = 500
+
+	// CheckpointKind is the kind of entities keeping cursors of StreamIterate
+	CheckpointKind = "GogooCheckpoint"
+)
+
+// IterateOptions configures StreamIterate
+type IterateOptions struct {
+	// Workers is the number of concurrent op calls.
+	// DefaultIterateWorkers is used if it is not positive.
+	Workers int
+	// BatchSize is the number of entities fetched by one query.
+	// DefaultIterateBatchSize is used if it is not positive.
+	BatchSize int
+	// StopOnError stops the iteration at the first failed op,
+	// otherwise all failures are collected and returned at the end.
+	StopOnError bool
+	// Checkpoint keeps the cursor of every finished batch, so that a crashed iteration could be resumed.
+	// The cursor stops advancing at the first batch with failed ops, so they are processed again on resume.
+	Checkpoint Checkpointer
+	// Progress is called after every finished batch
+	Progress func(IterateProgress)
+}
+
+// IterateProgress is the progress reported after every finished batch
+type IterateProgress struct {
+	Processed int
+	Failed    int
+	Cursor    string
+}
+
+// Checkpointer loads/saves the cursor of an iteration
+type Checkpointer interface {
+	// Load returns the saved cursor and whether the iteration has been done
+	Load() (cursor string, done bool, err error)
+	// Save saves the cursor of the finished batch
+	Save(cursor string, done bool) error
+}
+
+// StreamIterate iterates the query result batch by batch, and calls op on at most
+// `Workers` entities concurrently. The cursor is checkpointed only after all entities
+// of the batch have been processed, so that a resumed iteration processes each entity
+// at least once. If some op fail, the returned error is type of MultiError.
+// The limit of the query is overridden by BatchSize, so a limited query should be
+// stopped by op instead, e.g. by canceling the context.
+func (m *Manager) StreamIterate(
+	ctx context.Context,
+	query *datastore.Query,
+	dst Cloneable,
+	op func(ctx context.Context, key *datastore.Key, dst interface{}) error,
+	opts IterateOptions) error {
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultIterateWorkers
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultIterateBatchSize
+	}
+
+	cursor := ""
+	if opts.Checkpoint != nil {
+		c, done, err := opts.Checkpoint.Load()
+		if err != nil {
+			return errors.Wrap(err, "load checkpoint fails")
+		}
+		if done {
+			log.Infof("Iteration has been done by checkpoint")
+			return nil
+		}
+		cursor = c
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type item struct {
+		index int
+		key   *datastore.Key
+		dst   interface{}
+	}
+
+	var merr MultiError
+	var mu sync.Mutex
+	progress := IterateProgress{Cursor: cursor}
+	// checkpointed is false since the first batch with failed ops
+	checkpointed := true
+
+	for {
+		q := query.Limit(batchSize)
+		if cursor != "" {
+			c, err := datastore.DecodeCursor(cursor)
+			if err != nil {
+				return errors.Errorf("Bad cursor %q: %v", cursor, err)
+			}
+			q = q.Start(c)
+		}
+
+		items := make(chan item, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for en := range items {
+					if ctx.Err() != nil {
+						continue
+					}
+					if err := op(ctx, en.key, en.dst); err != nil {
+						mu.Lock()
+						merr = append(merr, &KeyError{Index: en.index, Key: en.key, Err: err})
+						progress.Failed++
+						mu.Unlock()
+
+						if opts.StopOnError {
+							cancel()
+						}
+					}
+				}
+			}()
+		}
+
+		failed := progress.Failed
+		count := 0
+		var fetchErr error
+		it := m.Client.Run(ctx, q)
+		for ctx.Err() == nil {
+			key, err := it.Next(dst)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				fetchErr = err
+				break
+			}
+
+			items <- item{progress.Processed + count, key, dst.Clone()}
+			count++
+		}
+		close(items)
+		wg.Wait()
+
+		if opts.StopOnError && len(merr) > 0 {
+			return merr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fetchErr != nil {
+			return errors.Errorf("Failed fetching results: %v", fetchErr)
+		}
+
+		nextCursor, err := it.Cursor()
+		if err != nil {
+			return errors.Errorf("Failed fetching cursor: %v", err)
+		}
+		cursor = nextCursor.String()
+		done := count < batchSize
+
+		progress.Processed += count
+		progress.Cursor = cursor
+		log.Debugf("processed: count[%d], failed[%d]", progress.Processed, progress.Failed)
+
+		if progress.Failed > failed {
+			checkpointed = false
+		}
+		if opts.Checkpoint != nil && checkpointed {
+			if err := opts.Checkpoint.Save(cursor, done); err != nil {
+				return errors.Wrap(err, "save checkpoint fails")
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+// checkpoint is the entity of CheckpointKind
+type checkpoint struct {
+	Cursor    string    `datastore:"cursor,noindex"`
+	Done      bool      `datastore:"done"`
+	UpdatedAt time.Time `datastore:"updated_at"`
+}
+
+// DatastoreCheckpointer keeps the cursor in an entity of CheckpointKind
+type DatastoreCheckpointer struct {
+	m   *Manager
+	key *datastore.Key
+}
+
+// NewCheckpointer builds the checkpointer keeping the cursor under the name
+func (m *Manager) NewCheckpointer(name string) *DatastoreCheckpointer {
+	return &DatastoreCheckpointer{
+		m:   m,
+		key: m.BuildKey(CheckpointKind+m.SuffixOfKind, name),
+	}
+}
+
+// Load loads the cursor, an empty cursor is returned if nothing has been saved
+func (c *DatastoreCheckpointer) Load() (string, bool, error) {
+	cp := &checkpoint{}
+	err := c.m.Client.Get(context.Background(), c.key, cp)
+	if err == datastore.ErrNoSuchEntity {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "checkpoint[%s]", c.key.Name())
+	}
+
+	return cp.Cursor, cp.Done, nil
+}
+
+// Save saves the cursor
+func (c *DatastoreCheckpointer) Save(cursor string, done bool) error {
+	cp := &checkpoint{
+		Cursor:    cursor,
+		Done:      done,
+		UpdatedAt: time.Now(),
+	}
+	if _, err := c.m.Client.Put(context.Background(), c.key, cp); err != nil {
+		return errors.Wrapf(err, "checkpoint[%s]", c.key.Name())
+	}
+
+	return nil
+}
+
+// Reset deletes the saved cursor, so that the next iteration starts from the beginning
+func (c *DatastoreCheckpointer) Reset() error {
+	return c.m.Delete(c.key)
+}
@@ -0,0 +1,234 @@
+package gds
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+// LeaseKind is the kind of entities keeping leases
+const LeaseKind = "GogooLease"
+
+var (
+	// ErrLeaseHeld is returned when the lease is held by another owner
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	// ErrLeaseLost is returned when the lease has been acquired by another owner
+	ErrLeaseLost = errors.New("lease is lost")
+)
+
+// leaseEntity is the entity of LeaseKind keyed by lease name.
+// It is kept after release, so that the fencing token keeps increasing.
+type leaseEntity struct {
+	Owner     string    `datastore:"owner"`
+	Token     int64     `datastore:"token"`
+	ExpiresAt time.Time `datastore:"expires_at"`
+}
+
+// Lease is the lease acquired by AcquireLease. Expiration is judged by the local clock,
+// so ttl should be much longer than the clock skew between hosts.
+type Lease struct {
+	Name  string
+	Owner string
+	// Token is the fencing token increasing on every acquisition. Resources guarded
+	// by the lease should reject requests carrying a token smaller than the latest one.
+	Token int64
+
+	m   *Manager
+	key *datastore.Key
+	ttl time.Duration
+
+	mu        sync.Mutex
+	expiresAt time.Time
+	stop      chan struct{}
+	lost      chan struct{}
+	lostOnce  sync.Once
+}
+
+// AcquireLease acquires the lease of the name for ttl.
+// ErrLeaseHeld is returned if the lease is held by another owner and not expired.
+func (m *Manager) AcquireLease(name, owner string, ttl time.Duration) (*Lease, error) {
+	log.Tracef("AcquireLease: name[%s], owner[%s], ttl[%s]", name, owner, ttl)
+
+	l := &Lease{
+		Name:  name,
+		Owner: owner,
+		m:     m,
+		key:   m.BuildKey(LeaseKind+m.SuffixOfKind, name),
+		ttl:   ttl,
+		lost:  make(chan struct{}),
+	}
+
+	var expiresAt time.Time
+	_, err := m.Client.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		entity := &leaseEntity{}
+		if err := tx.Get(l.key, entity); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		if entity.Owner != "" && entity.Owner != owner && now.Before(entity.ExpiresAt) {
+			return ErrLeaseHeld
+		}
+
+		entity.Owner = owner
+		entity.Token++
+		entity.ExpiresAt = now.Add(ttl)
+		if _, err := tx.Put(l.key, entity); err != nil {
+			return err
+		}
+
+		l.Token = entity.Token
+		expiresAt = entity.ExpiresAt
+		return nil
+	})
+	if err == ErrLeaseHeld {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "acquire lease fails: name[%s]", name)
+	}
+	l.expiresAt = expiresAt
+
+	return l, nil
+}
+
+// ExpiresAt returns the expiration time of the lease
+func (l *Lease) ExpiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.expiresAt
+}
+
+// Renew extends the lease for ttl. ErrLeaseLost is returned if another owner has acquired it.
+func (l *Lease) Renew() error {
+	log.Tracef("Renew lease: name[%s], owner[%s], token[%d]", l.Name, l.Owner, l.Token)
+
+	var expiresAt time.Time
+	_, err := l.m.Client.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		entity := &leaseEntity{}
+		if err := tx.Get(l.key, entity); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrLeaseLost
+			}
+			return err
+		}
+		if entity.Owner != l.Owner || entity.Token != l.Token {
+			return ErrLeaseLost
+		}
+
+		entity.ExpiresAt = time.Now().Add(l.ttl)
+		if _, err := tx.Put(l.key, entity); err != nil {
+			return err
+		}
+
+		expiresAt = entity.ExpiresAt
+		return nil
+	})
+	if err == ErrLeaseLost {
+		l.markLost()
+		return err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "renew lease fails: name[%s]", l.Name)
+	}
+
+	l.mu.Lock()
+	l.expiresAt = expiresAt
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Release stops the automatic renewal and releases the lease if it's still held
+func (l *Lease) Release() error {
+	log.Tracef("Release lease: name[%s], owner[%s], token[%d]", l.Name, l.Owner, l.Token)
+
+	l.mu.Lock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.mu.Unlock()
+
+	_, err := l.m.Client.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		entity := &leaseEntity{}
+		if err := tx.Get(l.key, entity); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if entity.Owner != l.Owner || entity.Token != l.Token {
+			return nil
+		}
+
+		entity.Owner = ""
+		entity.ExpiresAt = time.Time{}
+		_, err := tx.Put(l.key, entity)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "release lease fails: name[%s]", l.Name)
+	}
+
+	return nil
+}
+
+// KeepAlive renews the lease every interval in a background goroutine till Release.
+// If the lease is acquired by another owner or cannot be renewed before expiration,
+// the channel returned by Lost is closed.
+func (l *Lease) KeepAlive(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	l.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			err := l.Renew()
+			if err == nil {
+				continue
+			}
+			if err == ErrLeaseLost {
+				log.Warnf("Lease lost: name[%s], owner[%s]", l.Name, l.Owner)
+				return
+			}
+
+			log.Warnf("Renew lease fails: name[%s], err[%s]", l.Name, err)
+			if time.Now().After(l.ExpiresAt()) {
+				log.Warnf("Lease expired: name[%s], owner[%s]", l.Name, l.Owner)
+				l.markLost()
+				return
+			}
+		}
+	}()
+}
+
+// Lost returns the channel closed when the lease is lost
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lease) markLost() {
+	l.lostOnce.Do(func() {
+		close(l.lost)
+	})
+}
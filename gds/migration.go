@@ -0,0 +1,326 @@
+package gds
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+const (
+	// MigrationKind is the kind of entities recording the state of migrations
+	MigrationKind = "GogooMigration"
+	// DefaultMigrationBatchSize is the default number of entities migrated by one batch
+	DefaultMigrationBatchSize = 500
+)
+
+// MigrateFunc migrates the properties of one entity in place and reports whether they are changed.
+// It should be idempotent, i.e. returns false for the entity which has been migrated.
+type MigrateFunc func(key *datastore.Key, props *datastore.PropertyList) (bool, error)
+
+// Migration migrates all entities of one kind
+type Migration struct {
+	// Version orders the migrations, it should be unique and positive
+	Version     int
+	Description string
+	// Kind is without the suffix, SuffixOfKind of the manager is appended as Repository does
+	Kind    string
+	Migrate MigrateFunc
+}
+
+// MigrationReport is the result of one migration
+type MigrationReport struct {
+	Version     int
+	Description string
+	Scanned     int
+	Changed     int
+	// Done is true if the migration has been finished before this run
+	Done   bool
+	DryRun bool
+}
+
+// migrationState is the entity of MigrationKind keyed by version
+type migrationState struct {
+	Description string    `datastore:"description,noindex"`
+	Cursor      string    `datastore:"cursor,noindex"`
+	Scanned     int       `datastore:"scanned,noindex"`
+	Changed     int       `datastore:"changed,noindex"`
+	Done        bool      `datastore:"done"`
+	UpdatedAt   time.Time `datastore:"updated_at"`
+}
+
+// Migrator runs the registered migrations in version order. The state of each migration
+// is recorded after every batch, so that an interrupted run resumes from the last cursor.
+type Migrator struct {
+	// BatchSize is the number of entities migrated by one batch.
+	// DefaultMigrationBatchSize is used if it is not positive.
+	BatchSize int
+
+	m          *Manager
+	migrations []Migration
+}
+
+// NewMigrator builds the migrator
+func (m *Manager) NewMigrator() *Migrator {
+	return &Migrator{m: m}
+}
+
+// Register registers the migration
+func (mg *Migrator) Register(migration Migration) error {
+	if migration.Version <= 0 {
+		return errors.Errorf("version should be positive: version[%d]", migration.Version)
+	}
+	if migration.Kind == "" || migration.Migrate == nil {
+		return errors.Errorf("kind and migrate func are required: version[%d]", migration.Version)
+	}
+	for _, registered := range mg.migrations {
+		if registered.Version == migration.Version {
+			return errors.Errorf("duplicated version: version[%d]", migration.Version)
+		}
+	}
+
+	mg.migrations = append(mg.migrations, migration)
+	sort.Sort(byMigrationVersion(mg.migrations))
+
+	return nil
+}
+
+// Run runs all unfinished migrations in version order and stops at the first failure.
+// In dry-run mode nothing is written, and Changed of the report is the number of entities
+// which would be changed. Note that a dry run doesn't see the changes of prior pending migrations.
+func (mg *Migrator) Run(dryRun bool) ([]*MigrationReport, error) {
+	reports := []*MigrationReport{}
+	for _, migration := range mg.migrations {
+		report, err := mg.run(migration, dryRun)
+		if report != nil {
+			reports = append(reports, report)
+		}
+		if err != nil {
+			return reports, errors.Wrapf(err, "migration fails: version[%d]", migration.Version)
+		}
+	}
+
+	return reports, nil
+}
+
+func (mg *Migrator) run(migration Migration, dryRun bool) (*MigrationReport, error) {
+	log.Infof("Migration: version[%d], kind[%s], dryRun[%t]", migration.Version, migration.Kind, dryRun)
+
+	batchSize := mg.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+
+	stateKey := mg.stateKey(migration.Version)
+	state, err := mg.loadState(stateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{
+		Version:     migration.Version,
+		Description: migration.Description,
+		Scanned:     state.Scanned,
+		Changed:     state.Changed,
+		Done:        state.Done,
+		DryRun:      dryRun,
+	}
+	if state.Done {
+		return report, nil
+	}
+
+	state.Description = migration.Description
+	cursor := state.Cursor
+	for {
+		query := datastore.NewQuery(migration.Kind + mg.m.SuffixOfKind).Limit(batchSize)
+		if cursor != "" {
+			c, err := datastore.DecodeCursor(cursor)
+			if err != nil {
+				return report, errors.Errorf("Bad cursor %q: %v", cursor, err)
+			}
+			query = query.Start(c)
+		}
+
+		changedKeys := []*datastore.Key{}
+		changedProps := []datastore.PropertyList{}
+		count := 0
+
+		it := mg.m.Client.Run(context.Background(), query)
+		for {
+			var props datastore.PropertyList
+			key, err := it.Next(&props)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return report, errors.Errorf("Failed fetching results: %v", err)
+			}
+			count++
+
+			changed, err := migration.Migrate(key, &props)
+			if err != nil {
+				return report, errors.Wrapf(err, "key[%v]", key)
+			}
+			if changed {
+				changedKeys = append(changedKeys, key)
+				changedProps = append(changedProps, props)
+			}
+		}
+
+		if !dryRun && len(changedKeys) > 0 {
+			if _, err := mg.m.PutMulti(changedKeys, changedProps); err != nil {
+				return report, err
+			}
+		}
+
+		nextCursor, err := it.Cursor()
+		if err != nil {
+			return report, errors.Errorf("Failed fetching cursor: %v", err)
+		}
+		cursor = nextCursor.String()
+
+		report.Scanned += count
+		report.Changed += len(changedKeys)
+		log.Debugf("migrated: version[%d], scanned[%d], changed[%d]",
+			migration.Version, report.Scanned, report.Changed)
+
+		if dryRun {
+			if count < batchSize {
+				break
+			}
+			continue
+		}
+
+		state.Cursor = cursor
+		state.Scanned = report.Scanned
+		state.Changed = report.Changed
+		state.Done = count < batchSize
+		state.UpdatedAt = time.Now()
+		if _, err := mg.m.Client.Put(context.Background(), stateKey, state); err != nil {
+			return report, errors.Wrap(err, "save migration state fails")
+		}
+
+		if state.Done {
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// Status reports the recorded state of all registered migrations without running them
+func (mg *Migrator) Status() ([]*MigrationReport, error) {
+	reports := []*MigrationReport{}
+	for _, migration := range mg.migrations {
+		state, err := mg.loadState(mg.stateKey(migration.Version))
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, &MigrationReport{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Scanned:     state.Scanned,
+			Changed:     state.Changed,
+			Done:        state.Done,
+		})
+	}
+
+	return reports, nil
+}
+
+// Main is the command to run the migrations, which could be called by the main function
+// of the application, e.g. `mg.Main(os.Args[1:], os.Stdout)`. Flags:
+//
+//	-dry-run  reports how many entities would be changed without writing
+//	-status   reports the recorded state without running
+func (mg *Migrator) Main(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "report how many entities would be changed without writing")
+	status := fs.Bool("status", false, "report the recorded state without running")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var reports []*MigrationReport
+	var err error
+	if *status {
+		reports, err = mg.Status()
+	} else {
+		reports, err = mg.Run(*dryRun)
+	}
+
+	for _, r := range reports {
+		state := "pending"
+		if r.Done {
+			state = "done"
+		}
+		fmt.Fprintf(out, "version[%d]\tstate[%s]\tscanned[%d]\tchanged[%d]\tdryRun[%t]\t%s\n",
+			r.Version, state, r.Scanned, r.Changed, r.DryRun, r.Description)
+	}
+
+	return err
+}
+
+func (mg *Migrator) stateKey(version int) *datastore.Key {
+	return datastore.NewKey(context.Background(), MigrationKind+mg.m.SuffixOfKind, "", int64(version), nil)
+}
+
+func (mg *Migrator) loadState(key *datastore.Key) (*migrationState, error) {
+	state := &migrationState{}
+	err := mg.m.Client.Get(context.Background(), key, state)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, errors.Wrap(err, "load migration state fails")
+	}
+
+	return state, nil
+}
+
+// RenameProperty builds the MigrateFunc which renames the property
+func RenameProperty(oldName, newName string) MigrateFunc {
+	return func(key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		changed := false
+		for i := range *props {
+			if (*props)[i].Name == oldName {
+				(*props)[i].Name = newName
+				changed = true
+			}
+		}
+		return changed, nil
+	}
+}
+
+// ConvertProperty builds the MigrateFunc which converts the value of the property.
+// The convert func reports whether the value is changed.
+func ConvertProperty(name string, convert func(interface{}) (interface{}, bool, error)) MigrateFunc {
+	return func(key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		changed := false
+		for i := range *props {
+			if (*props)[i].Name != name {
+				continue
+			}
+
+			value, ok, err := convert((*props)[i].Value)
+			if err != nil {
+				return false, errors.Wrapf(err, "property[%s]", name)
+			}
+			if ok {
+				(*props)[i].Value = value
+				changed = true
+			}
+		}
+		return changed, nil
+	}
+}
+
+type byMigrationVersion []Migration
+
+func (a byMigrationVersion) Len() int           { return len(a) }
+func (a byMigrationVersion) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMigrationVersion) Less(i, j int) bool { return a[i].Version < a[j].Version }
@@ -0,0 +1,187 @@
+package gds
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+const (
+	// MaxPutMultiSize is the max number of entities written by one datastore call
+	MaxPutMultiSize = 500
+	// MaxDeleteMultiSize is the max number of keys deleted by one datastore call
+	MaxDeleteMultiSize = 500
+	// DefaultMultiWorkers is the default number of concurrent datastore calls of PutMulti/DeleteMulti
+	DefaultMultiWorkers = 8
+)
+
+var errBatchAborted = errors.New("batch aborted by another key in the same call")
+
+// KeyError is the failure of one key in multi-entity operations
+type KeyError struct {
+	// Index is the position of the key in the slice passed to the operation
+	Index int
+	Key   *datastore.Key
+	Err   error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key[%v]: %v", e.Key, e.Err)
+}
+
+// MultiError is returned by multi-entity operations and lists every failed key ordered by index
+type MultiError []*KeyError
+
+func (e MultiError) Error() string {
+	if len(e) == 0 {
+		return "no error"
+	}
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	return fmt.Sprintf("%d keys failed, first: %s", len(e), e[0].Error())
+}
+
+// Keys returns the failed keys
+func (e MultiError) Keys() []*datastore.Key {
+	keys := make([]*datastore.Key, len(e))
+	for i, keyErr := range e {
+		keys[i] = keyErr.Key
+	}
+
+	return keys
+}
+
+// PutMulti inserts/updates entities in chunks of MaxPutMultiSize concurrently.
+// The parameter `src` should be a slice with the same length as `keys`.
+// If some keys fail, the returned error is type of MultiError and the
+// returned keys of failed entities are nil.
+func (m *Manager) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	log.Tracef("PutMulti: count[%d]", len(keys))
+
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, errors.Errorf("src should be a slice: type[%T]", src)
+	}
+	if v.Len() != len(keys) {
+		return nil, errors.Errorf("length mismatch: keys[%d], src[%d]", len(keys), v.Len())
+	}
+
+	resultKeys := make([]*datastore.Key, len(keys))
+	merr := m.forEachChunk(len(keys), MaxPutMultiSize, func(lo, hi int) error {
+		putKeys, err := m.Client.PutMulti(context.Background(), keys[lo:hi], v.Slice(lo, hi).Interface())
+		if err != nil {
+			return err
+		}
+
+		for i, key := range putKeys {
+			resultKeys[lo+i] = key
+			setEntityKey(v.Index(lo+i), key)
+		}
+		if m.cache != nil {
+			m.cache.invalidate(putKeys...)
+		}
+		return nil
+	}, keys)
+	if len(merr) > 0 {
+		return resultKeys, merr
+	}
+
+	return resultKeys, nil
+}
+
+// DeleteMulti deletes entities in chunks of MaxDeleteMultiSize concurrently.
+// If some keys fail, the returned error is type of MultiError.
+func (m *Manager) DeleteMulti(keys []*datastore.Key) error {
+	log.Tracef("DeleteMulti: count[%d]", len(keys))
+
+	merr := m.forEachChunk(len(keys), MaxDeleteMultiSize, func(lo, hi int) error {
+		if err := m.Client.DeleteMulti(context.Background(), keys[lo:hi]); err != nil {
+			return err
+		}
+		if m.cache != nil {
+			m.cache.invalidate(keys[lo:hi]...)
+		}
+		return nil
+	}, keys)
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+// forEachChunk runs op on [lo, hi) chunks of n items with at most MultiWorkers concurrent calls,
+// and collects the failures of keys in failed chunks
+func (m *Manager) forEachChunk(n, size int, op func(lo, hi int) error, keys []*datastore.Key) MultiError {
+	workers := m.MultiWorkers
+	if workers <= 0 {
+		workers = DefaultMultiWorkers
+	}
+
+	var merr MultiError
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+
+	for lo := 0; lo < n; lo += size {
+		hi := lo + size
+		if hi > n {
+			hi = n
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(lo, hi int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := op(lo, hi); err != nil {
+				log.Warnf("Chunk fails: range[%d:%d], err[%s]", lo, hi, err)
+
+				mu.Lock()
+				merr = append(merr, chunkErrors(lo, keys[lo:hi], err)...)
+				mu.Unlock()
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+
+	sort.Sort(byKeyErrorIndex(merr))
+
+	return merr
+}
+
+// chunkErrors maps the error of one datastore call onto all keys of the call
+func chunkErrors(offset int, keys []*datastore.Key, err error) []*KeyError {
+	me, isMulti := err.(datastore.MultiError)
+
+	result := make([]*KeyError, 0, len(keys))
+	for i, key := range keys {
+		keyErr := err
+		if isMulti {
+			keyErr = errBatchAborted
+			if i < len(me) && me[i] != nil {
+				keyErr = me[i]
+			}
+		}
+		result = append(result, &KeyError{Index: offset + i, Key: key, Err: keyErr})
+	}
+
+	return result
+}
+
+type byKeyErrorIndex []*KeyError
+
+func (a byKeyErrorIndex) Len() int           { return len(a) }
+func (a byKeyErrorIndex) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byKeyErrorIndex) Less(i, j int) bool { return a[i].Index < a[j].Index }
@@ -0,0 +1,251 @@
+package gds
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+var (
+	// ErrInvalidPageToken is returned when the page token cannot be decoded
+	ErrInvalidPageToken = errors.New("invalid page token")
+	// ErrPageTokenMismatch is returned when the page token was issued for another query
+	ErrPageTokenMismatch = errors.New("page token mismatches the query")
+)
+
+// QueryBuilder builds the datastore query fluently. Every method returns a new builder,
+// so that a base builder could be shared safely.
+type QueryBuilder struct {
+	m           *Manager
+	kind        string
+	ancestor    *datastore.Key
+	filters     []queryFilter
+	orders      []string
+	projections []string
+	distinct    bool
+	limit       int
+}
+
+type queryFilter struct {
+	filter string
+	value  interface{}
+}
+
+// Page is one page of query result
+type Page struct {
+	Keys []*datastore.Key
+	// NextPageToken is empty if there is no more result
+	NextPageToken string
+}
+
+type pageToken struct {
+	Cursor      string `json:"c"`
+	Fingerprint string `json:"f"`
+}
+
+// NewQueryBuilder builds the query builder of the kind
+func (m *Manager) NewQueryBuilder(kind string) *QueryBuilder {
+	return &QueryBuilder{m: m, kind: kind}
+}
+
+// NewQueryBuilder builds the query builder of the kind of repository
+func (r *Repository[T]) NewQueryBuilder() *QueryBuilder {
+	return r.m.NewQueryBuilder(r.Kind())
+}
+
+func (b *QueryBuilder) clone() *QueryBuilder {
+	c := *b
+	c.filters = append([]queryFilter(nil), b.filters...)
+	c.orders = append([]string(nil), b.orders...)
+	c.projections = append([]string(nil), b.projections...)
+	return &c
+}
+
+// Filter adds the filter, op is one of "=", "<", "<=", ">" and ">="
+func (b *QueryBuilder) Filter(field, op string, value interface{}) *QueryBuilder {
+	c := b.clone()
+	c.filters = append(c.filters, queryFilter{fmt.Sprintf("%s %s", field, op), value})
+	return c
+}
+
+// Order adds the sort order, prefix "-" to the field for descending order
+func (b *QueryBuilder) Order(field string) *QueryBuilder {
+	c := b.clone()
+	c.orders = append(c.orders, field)
+	return c
+}
+
+// Project fetches only the fields
+func (b *QueryBuilder) Project(fields ...string) *QueryBuilder {
+	c := b.clone()
+	c.projections = append(c.projections, fields...)
+	return c
+}
+
+// DistinctOn returns only one result of each combination of the fields.
+// The fields are projected since datastore only supports distinct on projection queries.
+func (b *QueryBuilder) DistinctOn(fields ...string) *QueryBuilder {
+	c := b.Project(fields...)
+	c.distinct = true
+	return c
+}
+
+// Ancestor restricts the result to the entities under the ancestor
+func (b *QueryBuilder) Ancestor(ancestor *datastore.Key) *QueryBuilder {
+	c := b.clone()
+	c.ancestor = ancestor
+	return c
+}
+
+// Limit sets the page size, zero means no limit
+func (b *QueryBuilder) Limit(limit int) *QueryBuilder {
+	c := b.clone()
+	c.limit = limit
+	return c
+}
+
+// Query builds the datastore query
+func (b *QueryBuilder) Query() *datastore.Query {
+	query := datastore.NewQuery(b.kind)
+	if b.ancestor != nil {
+		query = query.Ancestor(b.ancestor)
+	}
+	for _, f := range b.filters {
+		query = query.Filter(f.filter, f.value)
+	}
+	for _, o := range b.orders {
+		query = query.Order(o)
+	}
+	if len(b.projections) > 0 {
+		query = query.Project(b.projections...)
+	}
+	if b.distinct {
+		query = query.Distinct()
+	}
+	if b.limit > 0 {
+		query = query.Limit(b.limit)
+	}
+
+	return query
+}
+
+// Fingerprint identifies the query regardless of page size
+func (b *QueryBuilder) Fingerprint() string {
+	parts := []string{"kind=" + b.kind}
+	if b.ancestor != nil {
+		parts = append(parts, "ancestor="+b.ancestor.String())
+	}
+	for _, f := range b.filters {
+		parts = append(parts, fmt.Sprintf("filter=%s|%T|%v", f.filter, f.value, f.value))
+	}
+	for _, o := range b.orders {
+		parts = append(parts, "order="+o)
+	}
+	for _, p := range b.projections {
+		parts = append(parts, "project="+p)
+	}
+	if b.distinct {
+		parts = append(parts, "distinct")
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// EncodePageToken encodes the cursor into an opaque and URL-safe page token of the query
+func (b *QueryBuilder) EncodePageToken(cursor datastore.Cursor) string {
+	raw, _ := json.Marshal(pageToken{Cursor: cursor.String(), Fingerprint: b.Fingerprint()})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// DecodePageToken decodes the page token, ErrPageTokenMismatch is returned
+// if the token was issued for another query
+func (b *QueryBuilder) DecodePageToken(token string) (datastore.Cursor, error) {
+	var pt pageToken
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+	if err := json.Unmarshal(raw, &pt); err != nil {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+	if pt.Fingerprint != b.Fingerprint() {
+		return datastore.Cursor{}, ErrPageTokenMismatch
+	}
+
+	cursor, err := datastore.DecodeCursor(pt.Cursor)
+	if err != nil {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+
+	return cursor, nil
+}
+
+// Page fetches one page of the query result starting from the page token (empty for the first page).
+// The parameter `dst` should be type of `*[]*<Entity>` or `*[]<Entity>`, which is replaced by the entities
+// of the page only, the previous pages are not kept.
+func (b *QueryBuilder) Page(token string, dst interface{}) (*Page, error) {
+	log.Tracef("Page: kind[%s], token[%s]", b.kind, token)
+
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Slice {
+		return nil, errors.Errorf("dst should be a pointer to slice: type[%T]", dst)
+	}
+	sv := dv.Elem()
+	// a new slice, so that the caller's slice of the previous page is untouched
+	sv.Set(reflect.MakeSlice(sv.Type(), 0, 0))
+	elemType := sv.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	query := b.Query()
+	if token != "" {
+		cursor, err := b.DecodePageToken(token)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Start(cursor)
+	}
+
+	page := &Page{Keys: []*datastore.Key{}}
+	it := b.m.Client.Run(context.Background(), query)
+	for {
+		ev := reflect.New(elemType)
+		key, err := it.Next(ev.Interface())
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("Failed fetching results: %v", err)
+		}
+
+		setEntityKey(ev, key)
+		if isPtr {
+			sv.Set(reflect.Append(sv, ev))
+		} else {
+			sv.Set(reflect.Append(sv, ev.Elem()))
+		}
+		page.Keys = append(page.Keys, key)
+	}
+
+	if b.limit > 0 && len(page.Keys) == b.limit {
+		cursor, err := it.Cursor()
+		if err != nil {
+			return nil, errors.Errorf("Failed fetching cursor: %v", err)
+		}
+		page.NextPageToken = b.EncodePageToken(cursor)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,278 @@
+package gds
+
+import (
+	"reflect"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+// KeyTag is the struct tag marking the `*datastore.Key` field of entity, e.g.
+//
+//	ID *datastore.Key `datastore:"-" gds:"key"`
+//
+// If no field is tagged, the field named `Key` is used.
+const KeyTag = "key"
+
+var keyType = reflect.TypeOf((*datastore.Key)(nil))
+
+// keyFields caches the index of key field of each entity type
+var keyFields = struct {
+	sync.RWMutex
+	m map[reflect.Type][]int
+}{m: map[reflect.Type][]int{}}
+
+// keyFieldIndex finds the key field of the struct type, nil if there is no key field
+func keyFieldIndex(t reflect.Type) []int {
+	keyFields.RLock()
+	index, ok := keyFields.m[t]
+	keyFields.RUnlock()
+	if ok {
+		return index
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("gds") == KeyTag && f.Type == keyType {
+			index = f.Index
+			break
+		}
+	}
+	if index == nil {
+		if f, ok := t.FieldByName("Key"); ok && f.Type == keyType {
+			index = f.Index
+		}
+	}
+
+	keyFields.Lock()
+	keyFields.m[t] = index
+	keyFields.Unlock()
+
+	return index
+}
+
+// entityStruct dereferences pointers/interfaces till the struct value, invalid value if it's not a struct
+func entityStruct(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+
+	return v
+}
+
+// setEntityKey uses reflection to setup the key field of entity
+func setEntityKey(v reflect.Value, key *datastore.Key) {
+	v = entityStruct(v)
+	if !v.IsValid() {
+		return
+	}
+
+	index := keyFieldIndex(v.Type())
+	if index == nil {
+		return
+	}
+	if f := v.FieldByIndex(index); f.CanSet() {
+		f.Set(reflect.ValueOf(key))
+	}
+}
+
+// getEntityKey uses reflection to get the key field of entity, nil if there is no key field
+func getEntityKey(v reflect.Value) *datastore.Key {
+	v = entityStruct(v)
+	if !v.IsValid() {
+		return nil
+	}
+
+	index := keyFieldIndex(v.Type())
+	if index == nil {
+		return nil
+	}
+
+	key, _ := v.FieldByIndex(index).Interface().(*datastore.Key)
+	return key
+}
+
+// Repository accesses entities of one kind with type T, which should be a struct
+type Repository[T any] struct {
+	m    *Manager
+	kind string
+}
+
+// NewRepository builds the repository of entity type T.
+// If kind is empty, the type name of T is used. SuffixOfKind of the manager is appended to the kind.
+func NewRepository[T any](m *Manager, kind string) (*Repository[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, errors.Errorf("entity should be a struct: type[%s]", t)
+	}
+	if kind == "" {
+		kind = t.Name()
+	}
+	if kind == "" {
+		return nil, errors.Errorf("kind of anonymous struct should be specified: type[%s]", t)
+	}
+
+	return &Repository[T]{m: m, kind: kind}, nil
+}
+
+// Kind returns the kind name with SuffixOfKind
+func (r *Repository[T]) Kind() string {
+	return r.kind + r.m.SuffixOfKind
+}
+
+// NameKey builds the key of the name under parent (nil for root entity)
+func (r *Repository[T]) NameKey(name string, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(context.Background(), r.Kind(), name, 0, parent)
+}
+
+// IDKey builds the key of the numeric ID under parent (nil for root entity)
+func (r *Repository[T]) IDKey(id int64, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(context.Background(), r.Kind(), "", id, parent)
+}
+
+// IncompleteKey builds the key which ID is allocated by datastore on Put
+func (r *Repository[T]) IncompleteKey(parent *datastore.Key) *datastore.Key {
+	return datastore.NewIncompleteKey(context.Background(), r.Kind(), parent)
+}
+
+// KeyOf returns the key kept in the key field of entity
+func (r *Repository[T]) KeyOf(entity *T) *datastore.Key {
+	return getEntityKey(reflect.ValueOf(entity))
+}
+
+// Get gets the entity by key
+func (r *Repository[T]) Get(key *datastore.Key) (*T, error) {
+	if err := r.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	entity := new(T)
+	if err := r.m.Get(key, entity); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+// GetMulti gets the entities by keys. If some keys fail, the error is datastore.MultiError
+// and the entities of failed keys are nil.
+func (r *Repository[T]) GetMulti(keys []*datastore.Key) ([]*T, error) {
+	for _, key := range keys {
+		if err := r.checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	entities := make([]*T, len(keys))
+	for i := range entities {
+		entities[i] = new(T)
+	}
+
+	err := r.m.GetMulti(keys, entities)
+	me, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if isMulti && me[i] != nil {
+			entities[i] = nil
+			continue
+		}
+		setEntityKey(reflect.ValueOf(entities[i]), key)
+	}
+
+	return entities, err
+}
+
+// Put inserts/updates the entity by its key field.
+// If the key field is nil, the entity is inserted with an allocated ID.
+func (r *Repository[T]) Put(entity *T) (*datastore.Key, error) {
+	key := r.KeyOf(entity)
+	if key == nil {
+		key = r.IncompleteKey(nil)
+	}
+	if err := r.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return r.m.Put(key, entity)
+}
+
+// PutMulti inserts/updates the entities by their key fields, see Manager.PutMulti
+func (r *Repository[T]) PutMulti(entities []*T) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(entities))
+	for i, entity := range entities {
+		keys[i] = r.KeyOf(entity)
+		if keys[i] == nil {
+			keys[i] = r.IncompleteKey(nil)
+		}
+		if err := r.checkKey(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.m.PutMulti(keys, entities)
+}
+
+// Delete deletes the entity by key
+func (r *Repository[T]) Delete(key *datastore.Key) error {
+	if err := r.checkKey(key); err != nil {
+		return err
+	}
+
+	return r.m.Delete(key)
+}
+
+// DeleteMulti deletes the entities by keys, see Manager.DeleteMulti
+func (r *Repository[T]) DeleteMulti(keys []*datastore.Key) error {
+	for _, key := range keys {
+		if err := r.checkKey(key); err != nil {
+			return err
+		}
+	}
+
+	return r.m.DeleteMulti(keys)
+}
+
+// NewQuery builds the query of the kind
+func (r *Repository[T]) NewQuery() *datastore.Query {
+	return datastore.NewQuery(r.Kind())
+}
+
+// AncestorQuery builds the query of entities under the ancestor
+func (r *Repository[T]) AncestorQuery(ancestor *datastore.Key) *datastore.Query {
+	return r.NewQuery().Ancestor(ancestor)
+}
+
+// Query fetches all entities by the query, which should be built by NewQuery/AncestorQuery
+func (r *Repository[T]) Query(query *datastore.Query) ([]*T, error) {
+	log.Tracef("Query: kind[%s]", r.Kind())
+
+	result := []*T{}
+	if _, err := r.m.GetAll(query, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (r *Repository[T]) checkKey(key *datastore.Key) error {
+	if key == nil {
+		return errors.New("Key cann't be null")
+	}
+	if key.Kind() != r.Kind() {
+		return errors.Errorf("kind mismatch: key[%s], repository[%s]", key.Kind(), r.Kind())
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package infra
+
+import (
+	"fmt"
+
+	"github.com/iKala/gogoo/gce"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// Apply carries out the changes of the plan in order and blocks till each change is done.
+// It stops at the first failed change, and the applied changes are kept.
+func (p *Provisioner) Apply(plan *Plan) error {
+	log.Infof("Apply: owner[%s], changes[%d]", plan.Spec.Owner, len(plan.Changes))
+
+	for _, change := range plan.Changes {
+		log.Infof("Applying: %s", change)
+		if err := change.apply(p); err != nil {
+			return errors.Wrapf(err, "apply fails: %s", change)
+		}
+	}
+
+	return nil
+}
+
+// PlanAndApply plans the spec and applies the plan, and returns the applied plan
+func (p *Provisioner) PlanAndApply(spec *Spec) (*Plan, error) {
+	plan, err := p.Plan(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, p.Apply(plan)
+}
+
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.Delete
+func (p *Provisioner) deleteDisk(spec *Spec, name string) error {
+	op, err := p.Gce.Service.Disks.Delete(spec.ProjectID, spec.Zone, name).Do()
+	if err != nil {
+		return err
+	}
+
+	return p.Gce.WaitOperation(spec.ProjectID, op)
+}
+
+func (p *Provisioner) createInstanceTemplate(spec *Spec, templateSpec *InstanceTemplateSpec, hash string) error {
+	overrides := gce.TemplateOverrides{}
+	if templateSpec.Overrides != nil {
+		overrides = *templateSpec.Overrides
+	}
+	overrides.Description = ownerMark(spec.Owner, hash)
+
+	_, err := p.Gce.DeriveInstanceTemplate(spec.ProjectID, templateSpec.Base, templateSpec.Name, &overrides)
+	return err
+}
+
+func (p *Provisioner) deleteInstanceTemplate(spec *Spec, name string) error {
+	op, err := p.Gce.DeleteInstanceTemplate(spec.ProjectID, name)
+	if err != nil {
+		return err
+	}
+
+	return p.Gce.WaitOperation(spec.ProjectID, op)
+}
+
+func (p *Provisioner) createVM(spec *Spec, vm *compute.Instance) error {
+	return p.Gce.NewVM(spec.ProjectID, spec.Zone, vm)
+}
+
+// https://godoc.org/google.golang.org/api/compute/v1#InstancesService.Delete
+func (p *Provisioner) deleteVM(spec *Spec, name string) error {
+	op, err := p.Gce.Service.Instances.Delete(spec.ProjectID, spec.Zone, name).Do()
+	if err != nil {
+		return err
+	}
+
+	return p.Gce.WaitOperation(spec.ProjectID, op)
+}
+
+// updateInstanceGroupManager sets the template if not empty, the size if not negative
+// and the target pools if not nil
+func (p *Provisioner) updateInstanceGroupManager(
+	spec *Spec, name, template string, size int64, targetPools []string) error {
+
+	service := p.Gce.Service.InstanceGroupManagers
+	wait := func(op *compute.Operation, err error) error {
+		if err != nil {
+			return err
+		}
+		return p.Gce.WaitOperation(spec.ProjectID, op)
+	}
+
+	if template != "" {
+		// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.SetInstanceTemplate
+		if err := wait(service.SetInstanceTemplate(spec.ProjectID, spec.Zone, name,
+			&compute.InstanceGroupManagersSetInstanceTemplateRequest{InstanceTemplate: template}).Do()); err != nil {
+			return errors.Wrap(err, "set instance template fails")
+		}
+	}
+	if targetPools != nil {
+		// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.SetTargetPools
+		if err := wait(service.SetTargetPools(spec.ProjectID, spec.Zone, name,
+			&compute.InstanceGroupManagersSetTargetPoolsRequest{TargetPools: targetPools}).Do()); err != nil {
+			return errors.Wrap(err, "set target pools fails")
+		}
+	}
+	if size >= 0 {
+		// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.Resize
+		if err := wait(service.Resize(spec.ProjectID, spec.Zone, name, size).Do()); err != nil {
+			return errors.Wrap(err, "resize fails")
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) updateTargetPool(spec *Spec, name string, added, removed []string) error {
+	urls := func(instances []string) []string {
+		result := []string{}
+		for _, instance := range instances {
+			result = append(result, fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/instances/%s",
+				spec.ProjectID, spec.Zone, instance))
+		}
+		return result
+	}
+
+	if len(added) > 0 {
+		op, err := p.Gce.AddInstancesIntoTargetPool(spec.ProjectID, spec.Region, name, urls(added))
+		if err != nil {
+			return err
+		}
+		if err := p.Gce.WaitOperation(spec.ProjectID, op); err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		op, err := p.Gce.RemoveInstancesFromTargetPool(spec.ProjectID, spec.Region, name, urls(removed))
+		if err != nil {
+			return err
+		}
+		if err := p.Gce.WaitOperation(spec.ProjectID, op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package infra provisions compute engine resources declared in a spec. Plan compares the spec
+// with the live resources and Apply carries out the plan in the order of the dependencies.
+// Resources created by a spec are marked with its owner in their descriptions, and only
+// the owned resources are updated or deleted.
+package infra
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/iKala/gogoo/gce"
+
+	"github.com/pkg/errors"
+)
+
+// OwnerMarkPrefix prefixes the descriptions of owned resources, e.g. `gogoo-infra:web:<hash>`
+const OwnerMarkPrefix = "gogoo-infra"
+
+// Provisioner plans and applies specs with the manager of compute engine
+type Provisioner struct {
+	Gce *gce.Manager `inject:""`
+}
+
+// Spec declares the resources of the owner in one zone
+type Spec struct {
+	// Owner names the spec, resources of the same owner not in the spec are deleted
+	Owner     string `json:"owner"`
+	ProjectID string `json:"projectId"`
+	Zone      string `json:"zone"`
+	Region    string `json:"region"`
+
+	Disks                 []*DiskSpec                 `json:"disks"`
+	InstanceTemplates     []*InstanceTemplateSpec     `json:"instanceTemplates"`
+	VMs                   []*VMSpec                   `json:"vms"`
+	InstanceGroupManagers []*InstanceGroupManagerSpec `json:"instanceGroupManagers"`
+	// TargetPools declares the VM members of existing target pools
+	TargetPools []*TargetPoolSpec `json:"targetPools"`
+
+	// baseDir is the directory of the spec file, VM template files are relative to it
+	baseDir string
+}
+
+// DiskSpec declares a persistent disk, which can grow but is never replaced
+type DiskSpec struct {
+	Name   string `json:"name"`
+	SizeGb int64  `json:"sizeGb"`
+	// Type is e.g. pd-ssd, pd-standard if empty
+	Type           string `json:"type"`
+	SourceImage    string `json:"sourceImage"`
+	SourceSnapshot string `json:"sourceSnapshot"`
+}
+
+// InstanceTemplateSpec declares an instance template derived from the base template.
+// Templates are immutable, so a changed template should be declared with a new name.
+type InstanceTemplateSpec struct {
+	Name      string                 `json:"name"`
+	Base      string                 `json:"base"`
+	Overrides *gce.TemplateOverrides `json:"overrides"`
+}
+
+// VMSpec declares a VM built from the VM template file, see gce.VMTemplateParams.
+// A VM is replaced when its rendered template changes.
+type VMSpec struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Vars is passed to the template as {{.Vars}}
+	Vars map[string]interface{} `json:"vars"`
+	// Disks are the names of the disks in the spec attached to the VM
+	Disks []string `json:"disks"`
+}
+
+// InstanceGroupManagerSpec declares a managed instance group
+type InstanceGroupManagerSpec struct {
+	Name string `json:"name"`
+	// BaseInstanceName is Name if empty
+	BaseInstanceName string   `json:"baseInstanceName"`
+	Template         string   `json:"template"`
+	Size             int64    `json:"size"`
+	TargetPools      []string `json:"targetPools"`
+}
+
+// TargetPoolSpec declares the VMs of the spec in the target pool
+type TargetPoolSpec struct {
+	Name      string   `json:"name"`
+	Instances []string `json:"instances"`
+}
+
+// LoadSpec loads the spec from the YAML or JSON file
+func LoadSpec(path string) (*Spec, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read spec fails: file[%s]", path)
+	}
+
+	spec, err := ParseSpec(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file[%s]", path)
+	}
+	spec.baseDir = filepath.Dir(path)
+
+	return spec, nil
+}
+
+// ParseSpec parses the spec in YAML or JSON, VM template files are relative to the working directory
+func ParseSpec(content []byte) (*Spec, error) {
+	spec := &Spec{}
+	if err := yaml.Unmarshal(content, spec); err != nil {
+		return nil, errors.Wrap(err, "parse spec fails")
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+func (spec *Spec) validate() error {
+	if spec.Owner == "" || spec.ProjectID == "" || spec.Zone == "" {
+		return errors.New("invalid spec: owner, projectId and zone are required")
+	}
+	if strings.Contains(spec.Owner, ":") {
+		return errors.Errorf("invalid spec: owner[%s] contains ':'", spec.Owner)
+	}
+	if len(spec.TargetPools) > 0 && spec.Region == "" {
+		return errors.New("invalid spec: region is required by target pools")
+	}
+
+	names := map[string]map[string]bool{}
+	unique := func(kind Kind, name string) error {
+		if name == "" {
+			return errors.Errorf("invalid spec: %s without name", kind)
+		}
+		if names[string(kind)] == nil {
+			names[string(kind)] = map[string]bool{}
+		}
+		if names[string(kind)][name] {
+			return errors.Errorf("invalid spec: duplicated %s[%s]", kind, name)
+		}
+		names[string(kind)][name] = true
+		return nil
+	}
+
+	for _, disk := range spec.Disks {
+		if err := unique(KindDisk, disk.Name); err != nil {
+			return err
+		}
+		if disk.SizeGb <= 0 {
+			return errors.Errorf("invalid spec: disk[%s] without sizeGb", disk.Name)
+		}
+	}
+	for _, template := range spec.InstanceTemplates {
+		if err := unique(KindInstanceTemplate, template.Name); err != nil {
+			return err
+		}
+		if template.Base == "" {
+			return errors.Errorf("invalid spec: instance template[%s] without base", template.Name)
+		}
+	}
+	for _, vm := range spec.VMs {
+		if err := unique(KindVM, vm.Name); err != nil {
+			return err
+		}
+		if vm.File == "" {
+			return errors.Errorf("invalid spec: VM[%s] without file", vm.Name)
+		}
+		for _, disk := range vm.Disks {
+			if !names[string(KindDisk)][disk] {
+				return errors.Errorf("invalid spec: VM[%s] attaches undeclared disk[%s]", vm.Name, disk)
+			}
+		}
+	}
+	for _, igm := range spec.InstanceGroupManagers {
+		if err := unique(KindInstanceGroupManager, igm.Name); err != nil {
+			return err
+		}
+		if igm.Template == "" || igm.Size < 0 {
+			return errors.Errorf("invalid spec: instance group manager[%s] without template or size", igm.Name)
+		}
+		if len(igm.TargetPools) > 0 && spec.Region == "" {
+			return errors.New("invalid spec: region is required by target pools")
+		}
+	}
+	for _, pool := range spec.TargetPools {
+		if err := unique(KindTargetPool, pool.Name); err != nil {
+			return err
+		}
+		for _, instance := range pool.Instances {
+			if !names[string(KindVM)][instance] {
+				return errors.Errorf("invalid spec: target pool[%s] has undeclared VM[%s]", pool.Name, instance)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ownerMark marks the description of the owned resource with the hash of its declaration
+func ownerMark(owner, hash string) string {
+	return fmt.Sprintf("%s:%s:%s", OwnerMarkPrefix, owner, hash)
+}
+
+// parseOwnerMark parses the owner and the hash from the description, ok is false if not owned by any spec
+func parseOwnerMark(description string) (owner, hash string, ok bool) {
+	parts := strings.SplitN(description, ":", 3)
+	if len(parts) != 3 || parts[0] != OwnerMarkPrefix {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+// hashOf hashes the JSON of the declaration
+func hashOf(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(raw)
+
+	return hex.EncodeToString(sum[:])[:12], nil
+}
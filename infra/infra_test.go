@@ -0,0 +1,274 @@
+package infra
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iKala/gogoo/config"
+	"github.com/iKala/gogoo/gce"
+
+	"github.com/facebookgo/inject"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/compute/v1"
+)
+
+var tested Provisioner
+var testedProjectID string
+var testedZone = "asia-east1-b"
+var testedRegion = "asia-east1"
+
+/*
+ * Prepare below resources before running test
+ */
+var baseTemplateName = "instance-template-test"
+var targetPoolName = "target-pool-test"
+
+func TestProvisionerTestSuite(t *testing.T) {
+	suite.Run(t, new(ProvisionerTestSuite))
+}
+
+type ProvisionerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProvisionerTestSuite) SetupSuite() {
+	gcloudConfig := config.LoadGcloudConfig(config.LoadAsset("/config/config.json"))
+	key, _ := ioutil.ReadAll(config.LoadAsset("/config/key.pem"))
+
+	testedProjectID = gcloudConfig.ProjectID
+
+	// Construct dependency graph
+	computeService, _ := gce.BuildGceService(gcloudConfig.ServiceAccount, key)
+
+	var g inject.Graph
+	err := g.Provide(
+		&inject.Object{Value: computeService},
+		&inject.Object{Value: &gce.Manager{}},
+		&inject.Object{Value: &tested},
+	)
+	if err != nil {
+		os.Exit(1)
+	}
+	if err := g.Populate(); err != nil {
+		os.Exit(1)
+	}
+	// :~)
+
+	log.Println("======== SetupSuite  ========")
+}
+
+func (suite *ProvisionerTestSuite) Test_ParseSpec() {
+	spec, err := ParseSpec([]byte(`
+owner: web
+projectId: gogoo
+zone: asia-east1-b
+region: asia-east1
+disks:
+- name: data
+  sizeGb: 10
+instanceTemplates:
+- name: web-v1
+  base: web-base
+  overrides:
+    image: projects/debian-cloud/global/images/family/debian-8
+vms:
+- name: web-1
+  file: vm.yaml
+  disks: [data]
+instanceGroupManagers:
+- name: web
+  template: web-v1
+  size: 2
+  targetPools: [web]
+targetPools:
+- name: web
+  instances: [web-1]
+`))
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(10), spec.Disks[0].SizeGb)
+	assert.Equal(suite.T(), "projects/debian-cloud/global/images/family/debian-8",
+		spec.InstanceTemplates[0].Overrides.Image)
+	assert.Equal(suite.T(), []string{"data"}, spec.VMs[0].Disks)
+	assert.Equal(suite.T(), []string{"web-1"}, spec.TargetPools[0].Instances)
+
+	invalids := []string{
+		`{"projectId": "gogoo", "zone": "asia-east1-b"}`,
+		`{"owner": "a:b", "projectId": "gogoo", "zone": "asia-east1-b"}`,
+		`{"owner": "web", "projectId": "gogoo", "zone": "asia-east1-b",
+			"disks": [{"name": "data", "sizeGb": 10}, {"name": "data", "sizeGb": 10}]}`,
+		`{"owner": "web", "projectId": "gogoo", "zone": "asia-east1-b",
+			"vms": [{"name": "web-1", "file": "vm.yaml", "disks": ["data"]}]}`,
+		`{"owner": "web", "projectId": "gogoo", "zone": "asia-east1-b",
+			"targetPools": [{"name": "web", "instances": ["web-1"]}]}`,
+	}
+	for i, invalid := range invalids {
+		_, err := ParseSpec([]byte(invalid))
+		assert.NotNil(suite.T(), err, "invalid[%d]", i)
+	}
+}
+
+func (suite *ProvisionerTestSuite) Test_Diff() {
+	spec := &Spec{
+		Owner: "web", ProjectID: "gogoo", Zone: "asia-east1-b", Region: "asia-east1",
+		Disks: []*DiskSpec{{Name: "data", SizeGb: 20}, {Name: "logs", SizeGb: 10}},
+		InstanceTemplates: []*InstanceTemplateSpec{
+			{Name: "web-v2", Base: "web-base"},
+		},
+		VMs: []*VMSpec{{Name: "web-1"}, {Name: "web-2"}},
+		InstanceGroupManagers: []*InstanceGroupManagerSpec{
+			{Name: "web", Template: "web-v2", Size: 3},
+		},
+		TargetPools: []*TargetPoolSpec{{Name: "web", Instances: []string{"web-1", "web-2"}}},
+	}
+	vms := map[string]*compute.Instance{
+		"web-1": {Name: "web-1", MachineType: "zones/asia-east1-b/machineTypes/n1-standard-1"},
+		"web-2": {Name: "web-2", MachineType: "zones/asia-east1-b/machineTypes/n1-standard-2"},
+	}
+
+	diskHash, _ := hashOf([]string{"", "", ""})
+	oldVM := &compute.Instance{Name: "web-2", MachineType: "zones/asia-east1-b/machineTypes/n1-standard-1"}
+	oldVMHash, _ := hashOf(oldVM)
+	live := &liveState{
+		disks: map[string]*compute.Disk{
+			"data":  {Name: "data", SizeGb: 10, Description: ownerMark("web", diskHash)},
+			"cache": {Name: "cache", SizeGb: 10, Description: ownerMark("web", diskHash)},
+			"other": {Name: "other", SizeGb: 10, Description: ownerMark("api", diskHash)},
+		},
+		templates: map[string]*compute.InstanceTemplate{
+			"web-v1":   {Name: "web-v1", Description: ownerMark("web", "x")},
+			"web-base": {Name: "web-base"},
+		},
+		vms: map[string]*compute.Instance{
+			"web-2": {Name: "web-2", Description: ownerMark("web", oldVMHash)},
+			"web-3": {Name: "web-3", Description: ownerMark("web", oldVMHash)},
+			"web-x": {Name: "web-x"},
+		},
+		igms: map[string]*compute.InstanceGroupManager{
+			"web": {Name: "web", BaseInstanceName: "web", Description: ownerMark("web", "x"),
+				InstanceTemplate: "projects/gogoo/global/instanceTemplates/web-v1", TargetSize: 3},
+		},
+		pools: map[string]*compute.TargetPool{
+			"web": {Name: "web", Instances: []string{
+				"https://www.googleapis.com/compute/v1/projects/gogoo/zones/asia-east1-b/instances/web-3",
+				"https://www.googleapis.com/compute/v1/projects/gogoo/zones/asia-east1-b/instances/web-x",
+			}},
+		},
+	}
+
+	plan, err := diff(spec, vms, live)
+	require.Nil(suite.T(), err)
+	changes := []string{}
+	for _, change := range plan.Changes {
+		changes = append(changes, change.String())
+	}
+	assert.Equal(suite.T(), []string{
+		"~ disk[data] sizeGb[10 => 20]",
+		"+ disk[logs]",
+		"+ instance_template[web-v2] from base[web-base]",
+		"+ vm[web-1]",
+		"-/+ vm[web-2] template changed",
+		"~ instance_group_manager[web] template[web-v1 => web-v2]",
+		"~ target_pool[web] instances[+web-1,web-2 -web-3]",
+		"- vm[web-3]",
+		"- instance_template[web-v1]",
+		"- disk[cache]",
+	}, changes)
+
+	// Declared resources owned by others are never touched
+	spec.Disks = append(spec.Disks, &DiskSpec{Name: "other", SizeGb: 10})
+	_, err = diff(spec, vms, live)
+	assert.NotNil(suite.T(), err)
+	spec.Disks = spec.Disks[:2]
+
+	// Disks never shrink
+	spec.Disks[0].SizeGb = 5
+	_, err = diff(spec, vms, live)
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *ProvisionerTestSuite) Test_PlanAndApply() {
+	if testing.Short() {
+		suite.T().Skip("provisioning takes minutes")
+	}
+
+	dir, err := ioutil.TempDir("", "gogoo-infra")
+	require.Nil(suite.T(), err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "vm.yaml"), []byte(`
+name: {{.Name}}
+machineType: zones/{{.Zone}}/machineTypes/{{.Vars.machineType}}
+disks:
+- boot: true
+  autoDelete: true
+  initializeParams:
+    sourceImage: projects/debian-cloud/global/images/family/debian-8
+networkInterfaces:
+- network: global/networks/default
+`), 0644)
+	require.Nil(suite.T(), err)
+
+	owner := fmt.Sprintf("infra-test-%d", time.Now().Unix())
+	vmName := owner + "-vm"
+	spec, err := ParseSpec([]byte(fmt.Sprintf(`
+owner: %s
+projectId: %s
+zone: %s
+region: %s
+disks:
+- name: %s-data
+  sizeGb: 10
+instanceTemplates:
+- name: %s-template
+  base: %s
+vms:
+- name: %s
+  file: %s
+  vars: {machineType: f1-micro}
+  disks: [%s-data]
+targetPools:
+- name: %s
+  instances: [%s]
+`, owner, testedProjectID, testedZone, testedRegion, owner, owner, baseTemplateName,
+		vmName, filepath.Join(dir, "vm.yaml"), owner, targetPoolName, vmName)))
+	require.Nil(suite.T(), err)
+
+	plan, err := tested.PlanAndApply(spec)
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 4, len(plan.Changes), plan.String())
+
+	// Nothing changes after applied
+	plan, err = tested.Plan(spec)
+	require.Nil(suite.T(), err)
+	assert.True(suite.T(), plan.Empty(), plan.String())
+
+	// Replace the VM and grow the disk
+	spec.VMs[0].Vars["machineType"] = "g1-small"
+	spec.Disks[0].SizeGb = 20
+	plan, err = tested.PlanAndApply(spec)
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(plan.Changes), plan.String())
+	vm, err := tested.Gce.GetVM(testedProjectID, testedZone, vmName)
+	require.Nil(suite.T(), err)
+	assert.True(suite.T(), strings.HasSuffix(vm.MachineType, "/g1-small"))
+
+	// Delete all the owned resources
+	plan, err = tested.PlanAndApply(&Spec{
+		Owner: owner, ProjectID: testedProjectID, Zone: testedZone, Region: testedRegion,
+		TargetPools: []*TargetPoolSpec{{Name: targetPoolName}},
+	})
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 4, len(plan.Changes), plan.String())
+}
+
+func (suite *ProvisionerTestSuite) TearDownSuite() {
+	log.Println("======== TearDown  ========")
+}
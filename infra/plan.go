@@ -0,0 +1,626 @@
+package infra
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/iKala/gogoo/gce"
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Kind is the kind of resources in the spec
+type Kind string
+
+// Kinds of resources in the order of dependencies
+const (
+	KindDisk                 Kind = "disk"
+	KindInstanceTemplate     Kind = "instance_template"
+	KindVM                   Kind = "vm"
+	KindInstanceGroupManager Kind = "instance_group_manager"
+	KindTargetPool           Kind = "target_pool"
+)
+
+var kindOrder = map[Kind]int{
+	KindDisk:                 0,
+	KindInstanceTemplate:     1,
+	KindVM:                   2,
+	KindInstanceGroupManager: 3,
+	KindTargetPool:           4,
+}
+
+// Action is the action on a resource
+type Action string
+
+// Actions of changes
+const (
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionReplace Action = "replace"
+	ActionDelete  Action = "delete"
+)
+
+var actionSymbols = map[Action]string{
+	ActionCreate:  "+",
+	ActionUpdate:  "~",
+	ActionReplace: "-/+",
+	ActionDelete:  "-",
+}
+
+// Change is the action on one resource
+type Change struct {
+	Action Action
+	Kind   Kind
+	Name   string
+	// Detail describes the reason of the change, e.g. the updated fields
+	Detail string
+
+	apply func(p *Provisioner) error
+}
+
+func (c *Change) String() string {
+	s := fmt.Sprintf("%s %s[%s]", actionSymbols[c.Action], c.Kind, c.Name)
+	if c.Detail != "" {
+		s += " " + c.Detail
+	}
+
+	return s
+}
+
+// Plan is the changes to bring the live resources to the spec. Creations, updates and replacements
+// come first in the order of dependencies, then deletions in the reverse order.
+type Plan struct {
+	Spec    *Spec
+	Changes []*Change
+}
+
+// Empty tells if the live resources match the spec
+func (plan *Plan) Empty() bool {
+	return len(plan.Changes) == 0
+}
+
+func (plan *Plan) String() string {
+	if plan.Empty() {
+		return "No changes"
+	}
+
+	var b bytes.Buffer
+	for _, change := range plan.Changes {
+		b.WriteString(change.String())
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// byApplyOrder sorts changes into the apply order
+type byApplyOrder []*Change
+
+func (a byApplyOrder) Len() int      { return len(a) }
+func (a byApplyOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byApplyOrder) Less(i, j int) bool {
+	di, dj := a[i].Action == ActionDelete, a[j].Action == ActionDelete
+	if di != dj {
+		return dj
+	}
+	if a[i].Kind != a[j].Kind {
+		if di {
+			return kindOrder[a[i].Kind] > kindOrder[a[j].Kind]
+		}
+		return kindOrder[a[i].Kind] < kindOrder[a[j].Kind]
+	}
+
+	return a[i].Name < a[j].Name
+}
+
+// liveState is the live resources relating to the spec
+type liveState struct {
+	disks     map[string]*compute.Disk
+	templates map[string]*compute.InstanceTemplate
+	vms       map[string]*compute.Instance
+	igms      map[string]*compute.InstanceGroupManager
+	pools     map[string]*compute.TargetPool
+}
+
+// Plan compares the spec with the live resources
+func (p *Provisioner) Plan(spec *Spec) (*Plan, error) {
+	log.Debugf("Plan: owner[%s], project[%s], zone[%s]", spec.Owner, spec.ProjectID, spec.Zone)
+
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	vms, err := p.renderVMs(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := p.readLiveState(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff(spec, vms, live)
+}
+
+// renderVMs renders the VMs in the spec with the attached disks
+func (p *Provisioner) renderVMs(spec *Spec) (map[string]*compute.Instance, error) {
+	vms := map[string]*compute.Instance{}
+	for _, vmSpec := range spec.VMs {
+		file := vmSpec.File
+		if !filepath.IsAbs(file) && spec.baseDir != "" {
+			file = filepath.Join(spec.baseDir, file)
+		}
+
+		vm, err := p.Gce.InitVMFromTemplateFile(file, &gce.VMTemplateParams{
+			ProjectID: spec.ProjectID,
+			Zone:      spec.Zone,
+			Name:      vmSpec.Name,
+			Vars:      vmSpec.Vars,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "render VM fails: VM[%s]", vmSpec.Name)
+		}
+		if vm.Name != vmSpec.Name {
+			return nil, errors.Errorf("VM template names another VM: VM[%s], name[%s]", vmSpec.Name, vm.Name)
+		}
+
+		for _, disk := range vmSpec.Disks {
+			vm.Disks = append(vm.Disks, &compute.AttachedDisk{
+				Source: fmt.Sprintf("zones/%s/disks/%s", spec.Zone, disk),
+			})
+		}
+		vms[vm.Name] = vm
+	}
+
+	return vms, nil
+}
+
+// readLiveState reads all pages of the live resources, the instance templates are the owned ones
+// and the declared ones
+func (p *Provisioner) readLiveState(spec *Spec) (*liveState, error) {
+	live := &liveState{
+		disks:     map[string]*compute.Disk{},
+		templates: map[string]*compute.InstanceTemplate{},
+		vms:       map[string]*compute.Instance{},
+		igms:      map[string]*compute.InstanceGroupManager{},
+		pools:     map[string]*compute.TargetPool{},
+	}
+
+	if err := p.readLiveDisks(spec, live); err != nil {
+		return nil, errors.Wrap(err, "list disks fails")
+	}
+	if err := p.readLiveTemplates(spec, live); err != nil {
+		return nil, errors.Wrap(err, "list instance templates fails")
+	}
+	if err := p.readLiveVMs(spec, live); err != nil {
+		return nil, errors.Wrap(err, "list VMs fails")
+	}
+	if err := p.readLiveInstanceGroupManagers(spec, live); err != nil {
+		return nil, errors.Wrap(err, "list instance group managers fails")
+	}
+
+	for _, poolSpec := range spec.TargetPools {
+		pool, err := p.Gce.GetTargetPool(spec.ProjectID, spec.Region, poolSpec.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get target pool fails: pool[%s]", poolSpec.Name)
+		}
+		live.pools[pool.Name] = pool
+	}
+
+	return live, nil
+}
+
+// https://godoc.org/google.golang.org/api/compute/v1#DisksService.List
+func (p *Provisioner) readLiveDisks(spec *Spec, live *liveState) error {
+	pageToken := ""
+	for {
+		call := p.Gce.Service.Disks.List(spec.ProjectID, spec.Zone)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return err
+		}
+
+		for _, disk := range res.Items {
+			live.disks[disk.Name] = disk
+		}
+
+		if res.NextPageToken == "" {
+			return nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// readLiveTemplates lists the templates marked by the owner, and gets the declared ones not owned,
+// which are reported by diff
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceTemplatesService.List
+func (p *Provisioner) readLiveTemplates(spec *Spec, live *liveState) error {
+	filter := fmt.Sprintf("description eq %s", regexp.QuoteMeta(ownerMark(spec.Owner, ""))+".*")
+
+	pageToken := ""
+	for {
+		call := p.Gce.Service.InstanceTemplates.List(spec.ProjectID).Filter(filter)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return err
+		}
+
+		for _, template := range res.Items {
+			live.templates[template.Name] = template
+		}
+
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	for _, templateSpec := range spec.InstanceTemplates {
+		if _, ok := live.templates[templateSpec.Name]; ok {
+			continue
+		}
+		template, err := p.Gce.GetInstanceTemplate(spec.ProjectID, templateSpec.Name)
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		live.templates[template.Name] = template
+	}
+
+	return nil
+}
+
+// https://godoc.org/google.golang.org/api/compute/v1#InstancesService.List
+func (p *Provisioner) readLiveVMs(spec *Spec, live *liveState) error {
+	pageToken := ""
+	for {
+		call := p.Gce.Service.Instances.List(spec.ProjectID, spec.Zone)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return err
+		}
+
+		for _, vm := range res.Items {
+			live.vms[vm.Name] = vm
+		}
+
+		if res.NextPageToken == "" {
+			return nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// https://godoc.org/google.golang.org/api/compute/v1#InstanceGroupManagersService.List
+func (p *Provisioner) readLiveInstanceGroupManagers(spec *Spec, live *liveState) error {
+	pageToken := ""
+	for {
+		call := p.Gce.Service.InstanceGroupManagers.List(spec.ProjectID, spec.Zone)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return err
+		}
+
+		for _, igm := range res.Items {
+			live.igms[igm.Name] = igm
+		}
+
+		if res.NextPageToken == "" {
+			return nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// diff computes the plan from the spec, the rendered VMs and the live resources
+func diff(spec *Spec, vms map[string]*compute.Instance, live *liveState) (*Plan, error) {
+	plan := &Plan{Spec: spec, Changes: []*Change{}}
+	add := func(action Action, kind Kind, name, detail string, apply func(p *Provisioner) error) {
+		plan.Changes = append(plan.Changes, &Change{Action: action, Kind: kind, Name: name, Detail: detail, apply: apply})
+	}
+
+	// owned checks the live resource of the declared name is owned by the spec
+	owned := func(kind Kind, name, description string) (string, error) {
+		owner, hash, ok := parseOwnerMark(description)
+		if !ok || owner != spec.Owner {
+			return "", errors.Errorf("%s[%s] exists but is not owned by owner[%s]", kind, name, spec.Owner)
+		}
+		return hash, nil
+	}
+	// deletable tells if the undeclared live resource is owned by the spec
+	deletable := func(description string, declared bool) bool {
+		owner, _, ok := parseOwnerMark(description)
+		return ok && owner == spec.Owner && !declared
+	}
+
+	// Disks
+	declaredDisks := map[string]bool{}
+	for _, diskSpec := range spec.Disks {
+		declaredDisks[diskSpec.Name] = true
+		hash, err := hashOf([]string{diskSpec.Type, diskSpec.SourceImage, diskSpec.SourceSnapshot})
+		if err != nil {
+			return nil, err
+		}
+
+		disk, exists := live.disks[diskSpec.Name]
+		if !exists {
+			name, options := diskSpec.Name, newDiskOptions(spec, diskSpec, hash)
+			add(ActionCreate, KindDisk, name, "", func(p *Provisioner) error {
+				_, err := p.Gce.NewDiskWithOptions(spec.ProjectID, spec.Zone, name, options)
+				return err
+			})
+			continue
+		}
+
+		liveHash, err := owned(KindDisk, disk.Name, disk.Description)
+		if err != nil {
+			return nil, err
+		}
+		if liveHash != hash {
+			return nil, errors.Errorf("disk[%s] type or source changed, disks are never replaced", disk.Name)
+		}
+		if diskSpec.SizeGb < disk.SizeGb {
+			return nil, errors.Errorf("disk[%s] cannot shrink: sizeGb[%d => %d]", disk.Name, disk.SizeGb, diskSpec.SizeGb)
+		}
+		if diskSpec.SizeGb > disk.SizeGb {
+			name, sizeGb := disk.Name, diskSpec.SizeGb
+			add(ActionUpdate, KindDisk, name, fmt.Sprintf("sizeGb[%d => %d]", disk.SizeGb, sizeGb),
+				func(p *Provisioner) error { return p.Gce.ResizeDisk(spec.ProjectID, spec.Zone, name, sizeGb) })
+		}
+	}
+	for name, disk := range live.disks {
+		if deletable(disk.Description, declaredDisks[name]) {
+			n := name
+			add(ActionDelete, KindDisk, n, "", func(p *Provisioner) error { return p.deleteDisk(spec, n) })
+		}
+	}
+
+	// Instance templates
+	declaredTemplates := map[string]bool{}
+	for _, templateSpec := range spec.InstanceTemplates {
+		declaredTemplates[templateSpec.Name] = true
+		hash, err := hashOf(templateSpec)
+		if err != nil {
+			return nil, err
+		}
+
+		template, exists := live.templates[templateSpec.Name]
+		if !exists {
+			t, h := templateSpec, hash
+			add(ActionCreate, KindInstanceTemplate, t.Name, "from base["+t.Base+"]",
+				func(p *Provisioner) error { return p.createInstanceTemplate(spec, t, h) })
+			continue
+		}
+
+		liveHash, err := owned(KindInstanceTemplate, template.Name, template.Description)
+		if err != nil {
+			return nil, err
+		}
+		if liveHash != hash {
+			return nil, errors.Errorf("instance template[%s] changed, declare the change with a new name",
+				template.Name)
+		}
+	}
+	for name, template := range live.templates {
+		if deletable(template.Description, declaredTemplates[name]) {
+			n := name
+			add(ActionDelete, KindInstanceTemplate, n, "",
+				func(p *Provisioner) error { return p.deleteInstanceTemplate(spec, n) })
+		}
+	}
+
+	// VMs
+	ownedVMs := map[string]bool{}
+	for name, vm := range live.vms {
+		if owner, _, ok := parseOwnerMark(vm.Description); ok && owner == spec.Owner {
+			ownedVMs[name] = true
+		}
+	}
+	for _, vmSpec := range spec.VMs {
+		vm := vms[vmSpec.Name]
+		vm.Description = ""
+		hash, err := hashOf(vm)
+		if err != nil {
+			return nil, err
+		}
+		vm.Description = ownerMark(spec.Owner, hash)
+
+		liveVM, exists := live.vms[vm.Name]
+		if !exists {
+			add(ActionCreate, KindVM, vm.Name, "", func(p *Provisioner) error { return p.createVM(spec, vm) })
+			continue
+		}
+
+		liveHash, err := owned(KindVM, liveVM.Name, liveVM.Description)
+		if err != nil {
+			return nil, err
+		}
+		if liveHash != hash {
+			add(ActionReplace, KindVM, vm.Name, "template changed", func(p *Provisioner) error {
+				if err := p.deleteVM(spec, vm.Name); err != nil {
+					return err
+				}
+				return p.createVM(spec, vm)
+			})
+		}
+	}
+	for name, vm := range live.vms {
+		if deletable(vm.Description, vms[name] != nil) {
+			n := name
+			add(ActionDelete, KindVM, n, "", func(p *Provisioner) error { return p.deleteVM(spec, n) })
+		}
+	}
+
+	// Instance group managers
+	declaredIgms := map[string]bool{}
+	for _, igmSpec := range spec.InstanceGroupManagers {
+		declaredIgms[igmSpec.Name] = true
+		hash, err := hashOf(igmSpec)
+		if err != nil {
+			return nil, err
+		}
+		igm := newInstanceGroupManager(spec, igmSpec, hash)
+
+		liveIgm, exists := live.igms[igm.Name]
+		if !exists {
+			add(ActionCreate, KindInstanceGroupManager, igm.Name, "",
+				func(p *Provisioner) error { return p.Gce.NewInstanceGroupManager(spec.ProjectID, spec.Zone, igm) })
+			continue
+		}
+
+		if _, err := owned(KindInstanceGroupManager, liveIgm.Name, liveIgm.Description); err != nil {
+			return nil, err
+		}
+		if liveIgm.BaseInstanceName != igm.BaseInstanceName {
+			add(ActionReplace, KindInstanceGroupManager, igm.Name,
+				fmt.Sprintf("baseInstanceName[%s => %s]", liveIgm.BaseInstanceName, igm.BaseInstanceName),
+				func(p *Provisioner) error {
+					if err := p.Gce.DeleteInstanceGroupManager(spec.ProjectID, spec.Zone, igm.Name); err != nil {
+						return err
+					}
+					return p.Gce.NewInstanceGroupManager(spec.ProjectID, spec.Zone, igm)
+				})
+			continue
+		}
+
+		details := []string{}
+		liveTemplate := formatutil.GetLastSplit(liveIgm.InstanceTemplate, "/")
+		template := ""
+		if liveTemplate != igmSpec.Template {
+			template = igm.InstanceTemplate
+			details = append(details, fmt.Sprintf("template[%s => %s]", liveTemplate, igmSpec.Template))
+		}
+		size := int64(-1)
+		if liveIgm.TargetSize != igm.TargetSize {
+			size = igm.TargetSize
+			details = append(details, fmt.Sprintf("size[%d => %d]", liveIgm.TargetSize, igm.TargetSize))
+		}
+		livePools, pools := lastSegments(liveIgm.TargetPools), lastSegments(igm.TargetPools)
+		var targetPools []string
+		if strings.Join(livePools, ",") != strings.Join(pools, ",") {
+			targetPools = igm.TargetPools
+			details = append(details, fmt.Sprintf("targetPools[%s => %s]",
+				strings.Join(livePools, ","), strings.Join(pools, ",")))
+		}
+		if len(details) > 0 {
+			name := igm.Name
+			add(ActionUpdate, KindInstanceGroupManager, name, strings.Join(details, ", "),
+				func(p *Provisioner) error {
+					return p.updateInstanceGroupManager(spec, name, template, size, targetPools)
+				})
+		}
+	}
+	for name, igm := range live.igms {
+		if deletable(igm.Description, declaredIgms[name]) {
+			n := name
+			add(ActionDelete, KindInstanceGroupManager, n, "",
+				func(p *Provisioner) error { return p.Gce.DeleteInstanceGroupManager(spec.ProjectID, spec.Zone, n) })
+		}
+	}
+
+	// Target pool members, only VMs of the spec are added or removed
+	for _, poolSpec := range spec.TargetPools {
+		pool, exists := live.pools[poolSpec.Name]
+		if !exists {
+			return nil, errors.Errorf("target pool[%s] not found", poolSpec.Name)
+		}
+
+		members := map[string]bool{}
+		for _, instance := range pool.Instances {
+			members[formatutil.GetLastSplit(instance, "/")] = true
+		}
+		desired := map[string]bool{}
+		added := []string{}
+		for _, instance := range poolSpec.Instances {
+			desired[instance] = true
+			if !members[instance] {
+				added = append(added, instance)
+			}
+		}
+		removed := []string{}
+		for instance := range members {
+			if !desired[instance] && (ownedVMs[instance] || vms[instance] != nil) {
+				removed = append(removed, instance)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+
+		if len(added) > 0 || len(removed) > 0 {
+			name := pool.Name
+			add(ActionUpdate, KindTargetPool, name,
+				fmt.Sprintf("instances[+%s -%s]", strings.Join(added, ","), strings.Join(removed, ",")),
+				func(p *Provisioner) error { return p.updateTargetPool(spec, name, added, removed) })
+		}
+	}
+
+	sort.Sort(byApplyOrder(plan.Changes))
+	return plan, nil
+}
+
+func newDiskOptions(spec *Spec, diskSpec *DiskSpec, hash string) *gce.DiskOptions {
+	return &gce.DiskOptions{
+		SizeGb:         diskSpec.SizeGb,
+		Type:           diskSpec.Type,
+		SourceImage:    diskSpec.SourceImage,
+		SourceSnapshot: diskSpec.SourceSnapshot,
+		Description:    ownerMark(spec.Owner, hash),
+	}
+}
+
+func newInstanceGroupManager(
+	spec *Spec, igmSpec *InstanceGroupManagerSpec, hash string) *compute.InstanceGroupManager {
+
+	igm := &compute.InstanceGroupManager{
+		Name:             igmSpec.Name,
+		BaseInstanceName: igmSpec.BaseInstanceName,
+		InstanceTemplate: fmt.Sprintf("projects/%s/global/instanceTemplates/%s", spec.ProjectID, igmSpec.Template),
+		TargetSize:       igmSpec.Size,
+		Description:      ownerMark(spec.Owner, hash),
+		TargetPools:      []string{},
+	}
+	if igm.BaseInstanceName == "" {
+		igm.BaseInstanceName = igm.Name
+	}
+	for _, pool := range igmSpec.TargetPools {
+		igm.TargetPools = append(igm.TargetPools,
+			fmt.Sprintf("projects/%s/regions/%s/targetPools/%s", spec.ProjectID, spec.Region, pool))
+	}
+
+	return igm
+}
+
+// lastSegments returns the sorted names of the resource URLs
+func lastSegments(urls []string) []string {
+	names := []string{}
+	for _, url := range urls {
+		names = append(names, formatutil.GetLastSplit(url, "/"))
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -5,9 +5,11 @@ import (
 	"os"
 
 	"github.com/iKala/gogoo/cloudsql"
+	"github.com/iKala/gogoo/deploy"
 	"github.com/iKala/gogoo/gce"
 	"github.com/iKala/gogoo/gcm"
 	"github.com/iKala/gogoo/gds"
+	"github.com/iKala/gogoo/infra"
 	"github.com/iKala/gogoo/pubsub"
 	"github.com/iKala/gogoo/replicapoolupdater"
 	"github.com/iKala/gogoo/storage"
@@ -22,8 +24,11 @@ var gdsManager gds.Manager
 var gcmManager gcm.Manager
 var cloudSQLManager cloudsql.Manager
 var rpuManager replicapoolupdater.RpuManager
+var migManager replicapoolupdater.MigManager
 var pbsbManager pubsub.Manager
 var storageManager storage.Manager
+var deployer deploy.Deployer
+var provisioner infra.Provisioner
 
 // AppContext as parameter object to initialize GoGoo
 type AppContext struct {
@@ -39,8 +44,11 @@ type GoGoo struct {
 	Monitor                        *gcm.Manager      `inject:""`
 	CloudSQL                       *cloudsql.Manager `inject:""`
 	*replicapoolupdater.RpuManager `inject:""`
-	PubSub                         *pubsub.Manager  `inject:""`
-	Storage                        *storage.Manager `inject:""`
+	Mig                            *replicapoolupdater.MigManager `inject:""`
+	PubSub                         *pubsub.Manager                `inject:""`
+	Storage                        *storage.Manager               `inject:""`
+	Deploy                         *deploy.Deployer               `inject:""`
+	Infra                          *infra.Provisioner             `inject:""`
 }
 
 // New creates a new GoGoo object.
@@ -64,6 +72,7 @@ func buildDependencyGraph(ctx AppContext) {
 	cloudmonitorService, _ := gcm.BuildCloudMonitorService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
 	sqlService, _ := cloudsql.BuildCloudSQLService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
 	rpuService, _ := replicapoolupdater.BuildRpuService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
+	migService, _ := replicapoolupdater.BuildMigService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
 	pbsbService, _ := pubsub.BuildPbsbService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
 	storageService, _ := storage.BuildStorageService(ctx.ServiceAccount, ctx.KeyOfServiceAccount)
 
@@ -74,6 +83,7 @@ func buildDependencyGraph(ctx AppContext) {
 		&inject.Object{Value: cloudmonitorService},
 		&inject.Object{Value: sqlService},
 		&inject.Object{Value: rpuService},
+		&inject.Object{Value: migService},
 		&inject.Object{Value: pbsbService},
 		&inject.Object{Value: storageService},
 		&inject.Object{Value: &gdsManager},
@@ -81,8 +91,11 @@ func buildDependencyGraph(ctx AppContext) {
 		&inject.Object{Value: &gcmManager},
 		&inject.Object{Value: &cloudSQLManager},
 		&inject.Object{Value: &rpuManager},
+		&inject.Object{Value: &migManager},
 		&inject.Object{Value: &pbsbManager},
 		&inject.Object{Value: &storageManager},
+		&inject.Object{Value: &deployer},
+		&inject.Object{Value: &provisioner},
 		&inject.Object{Value: &gogoo},
 	)
 	if err != nil {
@@ -0,0 +1,321 @@
+package replicapoolupdater
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iKala/gogoo/gce"
+	"github.com/iKala/gosak/formatutil"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	compute "google.golang.org/api/compute/v0.beta"
+)
+
+const (
+	// RollingUpdateActionReplace replaces the instances by new ones
+	RollingUpdateActionReplace = "REPLACE"
+	// RollingUpdateActionRestart restarts the instances in place
+	RollingUpdateActionRestart = "RESTART"
+
+	// UpdatePolicyProactive updates the instances actively
+	UpdatePolicyProactive = "PROACTIVE"
+	// UpdatePolicyOpportunistic updates the instances only when they are recreated by other reasons
+	UpdatePolicyOpportunistic = "OPPORTUNISTIC"
+
+	// ManagedInstanceActionNone is the current action of the instance which is idle
+	ManagedInstanceActionNone = "NONE"
+)
+
+// BuildMigService builds the compute beta service of MigManager, since versions and update policies
+// of managed instance groups are not in the pinned compute v1 API
+func BuildMigService(serviceEmail string, key []byte) (*compute.Service, error) {
+	conf := &jwt.Config{
+		Email:      serviceEmail,
+		PrivateKey: key,
+		Scopes: []string{
+			compute.ComputeScope,
+		},
+		TokenURL: google.JWTTokenURL,
+	}
+
+	service, err := compute.New(conf.Client(oauth2.NoContext))
+	if err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// MigManager provides rolling updates by compute beta managed instance groups,
+// which replaces RpuManager of the deprecated replicapoolupdater API.
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService
+type MigManager struct {
+	Service *compute.Service `inject:""`
+}
+
+// RollingUpdate is the rolling update of the managed instance group
+type RollingUpdate struct {
+	InstanceGroupManager string
+	// InstanceTemplate is the name or URL of the new template, empty to update the instances
+	// with the current template, e.g. rolling restart
+	InstanceTemplate string
+	// PreviousInstanceTemplate is set by Insert, which is the target of Rollback
+	PreviousInstanceTemplate string
+	// Version is the name of the version set by Insert or Rollback, which identifies the updated instances
+	Version string
+	// Action is RollingUpdateActionReplace or RollingUpdateActionRestart, replace by default
+	Action string
+	// MaxSurge and MaxUnavailable are the defaults of GCE if nil
+	MaxSurge       *compute.FixedOrPercent
+	MaxUnavailable *compute.FixedOrPercent
+}
+
+// RollingUpdateStatus is the progress of the rolling update of the managed instance group
+type RollingUpdateStatus struct {
+	InstanceGroupManager string
+	InstanceTemplate     string
+	// Version is the name of the latest version of the group, e.g. the one set by Insert or Rollback
+	Version    string
+	TargetSize int64
+	// Updated is the number of instances of the version without pending action
+	Updated int64
+	// Stable reports whether all instances are running without pending action
+	Stable bool
+}
+
+// Done reports whether all instances have been updated
+func (s *RollingUpdateStatus) Done() bool {
+	return s.Stable && s.Updated >= s.TargetSize
+}
+
+// Insert starts rolling update for instances in the managed instance group.
+// PreviousInstanceTemplate of rollingUpdate is set to the current template of the group.
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.Patch
+func (manager *MigManager) Insert(projectID, zone string, rollingUpdate *RollingUpdate) (*compute.Operation, error) {
+	log.Tracef("Insert: projectID[%s], zone[%s], igm[%s], template[%s]",
+		projectID, zone, rollingUpdate.InstanceGroupManager, rollingUpdate.InstanceTemplate)
+
+	igm, err := manager.Service.InstanceGroupManagers.Get(projectID, zone, rollingUpdate.InstanceGroupManager).Do()
+	if err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return nil, errRollingUpdate
+	}
+	rollingUpdate.PreviousInstanceTemplate = igm.InstanceTemplate
+
+	template := rollingUpdate.InstanceTemplate
+	if template == "" {
+		template = igm.InstanceTemplate
+	}
+
+	return manager.patch(projectID, zone, rollingUpdate, UpdatePolicyProactive, template)
+}
+
+// List lists the rolling update status of all managed instance groups in the zone
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.List
+func (manager *MigManager) List(projectID, zone string) ([]*RollingUpdateStatus, error) {
+	log.Tracef("List: projectID[%s], zone[%s]", projectID, zone)
+
+	list, err := manager.Service.InstanceGroupManagers.List(projectID, zone).Do()
+	if err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return nil, errRollingUpdate
+	}
+
+	statuses := make([]*RollingUpdateStatus, 0, len(list.Items))
+	for _, igm := range list.Items {
+		status, err := manager.status(projectID, zone, igm)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Get gets the rolling update status of the managed instance group
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.ListManagedInstances
+func (manager *MigManager) Get(projectID, zone, instanceGroupManager string) (*RollingUpdateStatus, error) {
+	log.Tracef("Get: projectID[%s], zone[%s], igm[%s]", projectID, zone, instanceGroupManager)
+
+	igm, err := manager.Service.InstanceGroupManagers.Get(projectID, zone, instanceGroupManager).Do()
+	if err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return nil, errRollingUpdate
+	}
+
+	return manager.status(projectID, zone, igm)
+}
+
+// Rollback rollbacks the rolling update to PreviousInstanceTemplate set by Insert
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.Patch
+func (manager *MigManager) Rollback(projectID, zone string, rollingUpdate *RollingUpdate) (*compute.Operation, error) {
+	log.Tracef("Rollback: projectID[%s], zone[%s], igm[%s], template[%s]",
+		projectID, zone, rollingUpdate.InstanceGroupManager, rollingUpdate.PreviousInstanceTemplate)
+
+	if rollingUpdate.PreviousInstanceTemplate == "" {
+		log.Warnf("Error: no previous template: igm[%s]", rollingUpdate.InstanceGroupManager)
+
+		return nil, errRollingUpdate
+	}
+
+	return manager.patch(projectID, zone, rollingUpdate, UpdatePolicyProactive, rollingUpdate.PreviousInstanceTemplate)
+}
+
+// patch sets the update policy and the only version of the template. The version is named by time,
+// so that the instances are updated even if the template is not changed.
+func (manager *MigManager) patch(
+	projectID, zone string, rollingUpdate *RollingUpdate, policyType, template string) (*compute.Operation, error) {
+
+	action := rollingUpdate.Action
+	if action == "" {
+		action = RollingUpdateActionReplace
+	}
+
+	version := fmt.Sprintf("gogoo-%d", time.Now().UnixNano())
+	templateURL := instanceTemplateURL(projectID, template)
+	igm := &compute.InstanceGroupManager{
+		InstanceTemplate: templateURL,
+		UpdatePolicy: &compute.InstanceGroupManagerUpdatePolicy{
+			Type:           policyType,
+			MinimalAction:  action,
+			MaxSurge:       rollingUpdate.MaxSurge,
+			MaxUnavailable: rollingUpdate.MaxUnavailable,
+		},
+		Versions: []*compute.InstanceGroupManagerVersion{
+			{
+				Name:             version,
+				InstanceTemplate: templateURL,
+			},
+		},
+	}
+
+	op, err := manager.Service.InstanceGroupManagers.Patch(
+		projectID, zone, rollingUpdate.InstanceGroupManager, igm).Do()
+	if err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return nil, errRollingUpdate
+	}
+	rollingUpdate.Version = version
+
+	return op, nil
+}
+
+// setUpdatePolicyType patches only the type of the update policy, see UpdatePolicyProactive
+func (manager *MigManager) setUpdatePolicyType(projectID, zone, instanceGroupManager, policyType string) error {
+	igm := &compute.InstanceGroupManager{
+		UpdatePolicy: &compute.InstanceGroupManagerUpdatePolicy{Type: policyType},
+	}
+
+	if _, err := manager.Service.InstanceGroupManagers.Patch(projectID, zone, instanceGroupManager, igm).Do(); err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return errRollingUpdate
+	}
+
+	return nil
+}
+
+// SetVersions patches the versions of the managed instance group with the proactive update policy,
+// e.g. the canary version with a target size besides the current version
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#InstanceGroupManagersService.Patch
+func (manager *MigManager) SetVersions(projectID, zone, instanceGroupManager string,
+	versions []*compute.InstanceGroupManagerVersion) (*compute.Operation, error) {
+
+	log.Tracef("SetVersions: projectID[%s], zone[%s], igm[%s], versions[%d]",
+		projectID, zone, instanceGroupManager, len(versions))
+
+	igm := &compute.InstanceGroupManager{
+		UpdatePolicy: &compute.InstanceGroupManagerUpdatePolicy{Type: UpdatePolicyProactive},
+		Versions:     versions,
+	}
+
+	return manager.Service.InstanceGroupManagers.Patch(projectID, zone, instanceGroupManager, igm).Do()
+}
+
+// WaitOperation blocks till the zone operation is done, see gce.Manager.WaitOperation
+//
+// https://godoc.org/google.golang.org/api/compute/v0.beta#ZoneOperationsService.Get
+func (manager *MigManager) WaitOperation(projectID string, op *compute.Operation) error {
+	log.Tracef("WaitOperation: project[%s], operation[%s], type[%s]", projectID, op.Name, op.OperationType)
+
+	startTime := time.Now()
+	for op.Status != gce.OperationStatusDone {
+		if time.Now().Sub(startTime) > gce.OperationTimeout {
+			log.Warnf("Operation timeout: operation[%s], type[%s]", op.Name, op.OperationType)
+			return gce.ErrOperationTimeout
+		}
+
+		time.Sleep(gce.OperationPollingInterval)
+
+		polled, err := manager.Service.ZoneOperations.Get(projectID, formatutil.GetLastSplit(op.Zone, "/"), op.Name).Do()
+		if err != nil {
+			return errors.Wrapf(err, "get operation fails: operation[%s]", op.Name)
+		}
+		op = polled
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return errors.Errorf("operation[%s] fails: %s", op.Name, op.Error.Errors[0].Message)
+	}
+
+	return nil
+}
+
+func (manager *MigManager) status(
+	projectID, zone string, igm *compute.InstanceGroupManager) (*RollingUpdateStatus, error) {
+
+	res, err := manager.Service.InstanceGroupManagers.ListManagedInstances(projectID, zone, igm.Name).Do()
+	if err != nil {
+		log.Warnf("Error: %s", err.Error())
+
+		return nil, errRollingUpdate
+	}
+
+	status := &RollingUpdateStatus{
+		InstanceGroupManager: igm.Name,
+		InstanceTemplate:     igm.InstanceTemplate,
+		TargetSize:           igm.TargetSize,
+		Stable:               igm.Status != nil && igm.Status.IsStable,
+	}
+	if len(igm.Versions) > 0 {
+		status.Version = igm.Versions[len(igm.Versions)-1].Name
+	}
+	// the version name is new for each update, the template may be the same, e.g. rolling restart
+	for _, mi := range res.ManagedInstances {
+		if mi.CurrentAction == ManagedInstanceActionNone && mi.Version != nil &&
+			mi.Version.Name == status.Version {
+			status.Updated++
+		}
+	}
+
+	return status, nil
+}
+
+// instanceTemplateURL returns the partial URL of the template which could be the name
+func instanceTemplateURL(projectID, template string) string {
+	if strings.Contains(template, "/") {
+		return template
+	}
+
+	return fmt.Sprintf("projects/%s/global/instanceTemplates/%s", projectID, template)
+}
+
+func lastSegment(url string) string {
+	split := strings.Split(url, "/")
+	return split[len(split)-1]
+}
@@ -33,6 +33,8 @@ func BuildRpuService(serviceEmail string, key []byte) (*rpu.Service, error) {
 }
 
 // RpuManager https://godoc.org/google.golang.org/api/replicapoolupdater/v1beta1
+//
+// Deprecated: the replicapoolupdater API is deprecated, use MigManager instead.
 type RpuManager struct {
 	Service *rpu.Service `inject:""`
 }
@@ -0,0 +1,318 @@
+package replicapoolupdater
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iKala/gogoo/gce"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	compute "google.golang.org/api/compute/v0.beta"
+)
+
+const (
+	// DefaultWatchInterval is the default interval of polling the managed instances
+	DefaultWatchInterval = 10 * time.Second
+	// DefaultWatchTimeout is the default timeout of the rolling update, paused time excluded
+	DefaultWatchTimeout = 30 * time.Minute
+	// DefaultHealthCheckTimeout is the default time for an updated instance to become healthy
+	DefaultHealthCheckTimeout = 5 * time.Minute
+
+	// InstanceStatusRunning ...
+	InstanceStatusRunning = "RUNNING"
+)
+
+var (
+	// ErrRollingUpdateCanceled is returned by Wait when the watcher is canceled
+	ErrRollingUpdateCanceled = errors.New("rolling update canceled")
+	// ErrRollingUpdateTimeout is returned by Wait when the rolling update isn't done in time
+	ErrRollingUpdateTimeout = errors.New("rolling update timeout")
+)
+
+// HealthCheckError is returned by Wait when the updated instance doesn't become healthy in time
+type HealthCheckError struct {
+	Instance string
+	// Err is the last error of the health check, nil if it was just unsatisfied
+	Err error
+	// RolledBack reports whether the rolling update has been rolled back
+	RolledBack bool
+	// RollbackVersion is the name of the version set by the rollback, which identifies the rolled back instances
+	RollbackVersion string
+}
+
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("health check fails: instance[%s], rolledBack[%t], err[%v]", e.Instance, e.RolledBack, e.Err)
+}
+
+// WatchOptions is the options of Watch
+type WatchOptions struct {
+	// Interval is DefaultWatchInterval if zero
+	Interval time.Duration
+	// Timeout is DefaultWatchTimeout if zero
+	Timeout time.Duration
+	// HealthCheck checks every updated instance, e.g. gce.VMConditionChecker or
+	// gcm.Manager.CPUUtilizationChecker. It's retried till satisfied or HealthCheckTimeout.
+	HealthCheck gce.VMConditionChecker
+	// HealthCheckTimeout is DefaultHealthCheckTimeout if zero
+	HealthCheckTimeout time.Duration
+	// AutoRollback rolls back the rolling update when the health check fails
+	AutoRollback bool
+}
+
+// InstanceProgress is the progress of one instance of the rolling update
+type InstanceProgress struct {
+	Instance       string
+	InstanceStatus string
+	CurrentAction  string
+	// Updated reports whether the instance runs the version of the rolling update without pending action
+	Updated bool
+	// Healthy reports whether the updated instance passed the health check
+	Healthy bool
+}
+
+// RollingUpdateWatcher follows the rolling update started by Insert to completion
+type RollingUpdateWatcher struct {
+	manager       *MigManager
+	projectID     string
+	zone          string
+	rollingUpdate *RollingUpdate
+	opts          WatchOptions
+
+	progress   chan *InstanceProgress
+	done       chan struct{}
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	err        error
+
+	mu       sync.Mutex
+	paused   bool
+	deadline time.Time
+}
+
+// Watch starts watching the rolling update started by Insert. The channel of Progress must be drained.
+// The watcher keeps a copy of rollingUpdate, which is not changed by the automatic rollback, see HealthCheckError.
+func (manager *MigManager) Watch(
+	projectID, zone string, rollingUpdate *RollingUpdate, opts WatchOptions) *RollingUpdateWatcher {
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultWatchInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultWatchTimeout
+	}
+	if opts.HealthCheckTimeout <= 0 {
+		opts.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+
+	ru := *rollingUpdate
+	w := &RollingUpdateWatcher{
+		manager:       manager,
+		projectID:     projectID,
+		zone:          zone,
+		rollingUpdate: &ru,
+		opts:          opts,
+		progress:      make(chan *InstanceProgress, 64),
+		done:          make(chan struct{}),
+		cancel:        make(chan struct{}),
+		deadline:      time.Now().Add(opts.Timeout),
+	}
+	go w.run()
+
+	return w
+}
+
+// Progress returns the channel of changed instance progress, which is closed when the watch ends
+func (w *RollingUpdateWatcher) Progress() <-chan *InstanceProgress {
+	return w.progress
+}
+
+// Wait blocks till the rolling update is done, canceled or failed
+func (w *RollingUpdateWatcher) Wait() error {
+	<-w.done
+	return w.err
+}
+
+// Pause stops updating more instances, the instances being updated are not interrupted
+func (w *RollingUpdateWatcher) Pause() error {
+	log.Debugf("Pause rolling update: igm[%s]", w.rollingUpdate.InstanceGroupManager)
+
+	if err := w.manager.setUpdatePolicyType(
+		w.projectID, w.zone, w.rollingUpdate.InstanceGroupManager, UpdatePolicyOpportunistic); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.paused = true
+	w.mu.Unlock()
+
+	return nil
+}
+
+// Resume resumes the paused rolling update, and the timeout restarts
+func (w *RollingUpdateWatcher) Resume() error {
+	log.Debugf("Resume rolling update: igm[%s]", w.rollingUpdate.InstanceGroupManager)
+
+	if err := w.manager.setUpdatePolicyType(
+		w.projectID, w.zone, w.rollingUpdate.InstanceGroupManager, UpdatePolicyProactive); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.paused = false
+	w.deadline = time.Now().Add(w.opts.Timeout)
+	w.mu.Unlock()
+
+	return nil
+}
+
+// Cancel pauses the rolling update and ends the watch, Wait returns ErrRollingUpdateCanceled.
+// Use MigManager.Rollback to revert the updated instances.
+func (w *RollingUpdateWatcher) Cancel() error {
+	log.Debugf("Cancel rolling update: igm[%s]", w.rollingUpdate.InstanceGroupManager)
+
+	err := w.manager.setUpdatePolicyType(
+		w.projectID, w.zone, w.rollingUpdate.InstanceGroupManager, UpdatePolicyOpportunistic)
+	w.cancelOnce.Do(func() {
+		close(w.cancel)
+	})
+
+	return err
+}
+
+func (w *RollingUpdateWatcher) run() {
+	defer close(w.done)
+	defer close(w.progress)
+
+	w.err = w.watch()
+	if w.err != nil {
+		log.Warnf("Rolling update fails: igm[%s], err[%s]", w.rollingUpdate.InstanceGroupManager, w.err)
+	}
+}
+
+func (w *RollingUpdateWatcher) watch() error {
+	last := map[string]InstanceProgress{}
+	// updatedAt is the first time the instance is seen updated
+	updatedAt := map[string]time.Time{}
+	healthy := map[string]bool{}
+
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.cancel:
+			return ErrRollingUpdateCanceled
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		paused, deadline := w.paused, w.deadline
+		w.mu.Unlock()
+		if !paused && time.Now().After(deadline) {
+			return ErrRollingUpdateTimeout
+		}
+
+		igm, managedInstances, err := w.poll()
+		if err != nil {
+			// transient errors are retried till timeout
+			log.Warnf("Poll rolling update fails: igm[%s], err[%s]", w.rollingUpdate.InstanceGroupManager, err)
+			continue
+		}
+
+		allDone := int64(len(managedInstances)) >= igm.TargetSize
+		for _, mi := range managedInstances {
+			p := w.instanceProgress(mi)
+			if p.Updated {
+				if _, ok := updatedAt[p.Instance]; !ok {
+					updatedAt[p.Instance] = time.Now()
+				}
+				if !healthy[p.Instance] {
+					ok, err := w.checkHealth(p.Instance)
+					if ok {
+						healthy[p.Instance] = true
+					} else if time.Now().Sub(updatedAt[p.Instance]) > w.opts.HealthCheckTimeout {
+						return w.failHealthCheck(p.Instance, err)
+					}
+				}
+				p.Healthy = healthy[p.Instance]
+			}
+			allDone = allDone && p.Updated && p.Healthy
+
+			if last[p.Instance] != *p {
+				last[p.Instance] = *p
+				select {
+				case w.progress <- p:
+				case <-w.cancel:
+					return ErrRollingUpdateCanceled
+				}
+			}
+		}
+
+		if allDone && igm.Status != nil && igm.Status.IsStable {
+			log.Infof("Rolling update done: igm[%s], version[%s]",
+				w.rollingUpdate.InstanceGroupManager, w.rollingUpdate.Version)
+			return nil
+		}
+	}
+}
+
+func (w *RollingUpdateWatcher) poll() (*compute.InstanceGroupManager, []*compute.ManagedInstance, error) {
+	igm, err := w.manager.Service.InstanceGroupManagers.Get(
+		w.projectID, w.zone, w.rollingUpdate.InstanceGroupManager).Do()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := w.manager.Service.InstanceGroupManagers.ListManagedInstances(
+		w.projectID, w.zone, w.rollingUpdate.InstanceGroupManager).Do()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return igm, res.ManagedInstances, nil
+}
+
+func (w *RollingUpdateWatcher) instanceProgress(mi *compute.ManagedInstance) *InstanceProgress {
+	return &InstanceProgress{
+		Instance:       lastSegment(mi.Instance),
+		InstanceStatus: mi.InstanceStatus,
+		CurrentAction:  mi.CurrentAction,
+		Updated: mi.CurrentAction == ManagedInstanceActionNone &&
+			mi.InstanceStatus == InstanceStatusRunning &&
+			mi.Version != nil && mi.Version.Name == w.rollingUpdate.Version,
+	}
+}
+
+func (w *RollingUpdateWatcher) checkHealth(instance string) (bool, error) {
+	if w.opts.HealthCheck == nil {
+		return true, nil
+	}
+
+	ok, err := w.opts.HealthCheck(w.projectID, w.zone, instance)
+	if err != nil {
+		log.Debugf("Health check fails: instance[%s], err[%s]", instance, err)
+		return false, err
+	}
+
+	return ok, nil
+}
+
+func (w *RollingUpdateWatcher) failHealthCheck(instance string, err error) error {
+	hcErr := &HealthCheckError{Instance: instance, Err: err}
+	if !w.opts.AutoRollback {
+		return hcErr
+	}
+
+	// Rollback sets the version of its argument, the watched version is kept
+	rollback := *w.rollingUpdate
+	if _, rollbackErr := w.manager.Rollback(w.projectID, w.zone, &rollback); rollbackErr != nil {
+		log.Warnf("Rollback fails: igm[%s], err[%s]", w.rollingUpdate.InstanceGroupManager, rollbackErr)
+		return hcErr
+	}
+	hcErr.RolledBack = true
+	hcErr.RollbackVersion = rollback.Version
+
+	return hcErr
+}
@@ -3,6 +3,8 @@ package storage
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 
 	"golang.org/x/oauth2"
@@ -87,6 +89,31 @@ func (s *Manager) ListFilesUnderPath(bucketName, path string) []*storage.Object
 	return files
 }
 
+// Upload uploads the content of reader as the object
+func (s *Manager) Upload(bucketName, objectName string, r io.Reader) (*storage.Object, error) {
+	log.Printf("Upload: bucket[%s], object[%s]", bucketName, objectName)
+
+	return s.objectsService.Insert(bucketName, &storage.Object{Name: objectName}).
+		Media(r).
+		Do()
+}
+
+// Download downloads the content of the object, the caller should close the returned reader
+func (s *Manager) Download(bucketName, objectName string) (io.ReadCloser, error) {
+	log.Printf("Download: bucket[%s], object[%s]", bucketName, objectName)
+
+	res, err := s.objectsService.Get(bucketName, objectName).Download()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Download fails: status[%s]", res.Status)
+	}
+
+	return res.Body, nil
+}
+
 // lListBuckets lists all buckets under some bucket
 func (s *Manager) ListBuckets(projectID string) {
 	buckets, err := s.bucketsService.List(projectID).Do()
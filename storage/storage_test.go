@@ -4,10 +4,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/facebookgo/inject"
 	"github.com/iKala/gogoo/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -73,6 +76,18 @@ func (suite *StorageManagerTestSuite) Test04_ListFilesUnderPath() {
 	}
 }
 
+func (suite *StorageManagerTestSuite) Test05_UploadThenDownload() {
+	_, err := tested.Upload("livehouse-test", "gogoo/upload-test.txt", strings.NewReader("content"))
+	assert.Nil(suite.T(), err)
+
+	r, err := tested.Download("livehouse-test", "gogoo/upload-test.txt")
+	require.Nil(suite.T(), err)
+	defer r.Close()
+
+	content, _ := ioutil.ReadAll(r)
+	assert.Equal(suite.T(), "content", string(content))
+}
+
 func (suite *StorageManagerTestSuite) TearDownSuite() {
 	log.Println("======== TearDown  ========")
 }